@@ -1,6 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
 	"github.com/bitmark-inc/bitmark-sdk-go/account"
 )
 
@@ -14,3 +26,129 @@ func getEncrKey(acct account.Account) account.EncrKey {
 		return nil
 	}
 }
+
+func accountsListCommand(cfg *config, args []string) error {
+	enc := json.NewEncoder(os.Stdout)
+	return storage.Accounts().ForEach(func(accountNo string, seed []byte) error {
+		return enc.Encode(map[string]string{"account": accountNo})
+	})
+}
+
+func accountsShowCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("accounts show", flag.ExitOnError)
+	showSeed := fs.Bool("seed", false, "include the seed of the account")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected the account number")
+	}
+	accountNo := fs.Arg(0)
+
+	val, err := storage.Accounts().Get(accountNo)
+	if err != nil {
+		return err
+	}
+	if len(val) == 0 {
+		return fmt.Errorf("account %s not found", accountNo)
+	}
+
+	acct, err := decodeAccount(val)
+	if err != nil {
+		return err
+	}
+
+	info := map[string]string{
+		"account":           accountNo,
+		"version":           string(acct.Version()),
+		"network":           string(acct.Network()),
+		"encryption_pubkey": hex.EncodeToString(getEncrKey(acct).PublicKeyBytes()),
+	}
+	if *showSeed {
+		info["seed"] = acct.Seed()
+		auditCommand(AuditExportAccount, accountNo, nil, nil)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func accountsImportCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("accounts import", flag.ExitOnError)
+	seed := fs.String("seed", "", "seed of the account, read from stdin if omitted")
+	register := fs.Bool("register", true, "register the encryption public key to the key server")
+	fs.Parse(args)
+
+	// avoid leaving the seed in the shell history
+	if *seed == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		*seed = strings.TrimSpace(line)
+	}
+
+	acct, err := account.FromSeed(*seed)
+	if err != nil {
+		return fmt.Errorf("invalid seed: %s", err)
+	}
+	if acct.Network() != bmksdk.GetNetwork() {
+		return fmt.Errorf("the account belongs to %s, not %s", acct.Network(), bmksdk.GetNetwork())
+	}
+
+	accountNo := acct.AccountNumber()
+	if _, err := getAccount(accountNo); err == nil {
+		return fmt.Errorf("account %s already exists", accountNo)
+	}
+
+	if *register {
+		if err := service.registerEncPubkey(context.Background(), acct); err != nil {
+			return err
+		}
+	}
+
+	err = addAccount(acct)
+	auditCommand(AuditImportAccount, accountNo, map[string]string{"register": strconv.FormatBool(*register)}, err)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(accountNo)
+	return nil
+}
+
+// accountsVerifyCommand re-derives every stored account from its seed
+// and checks it against the account number it is stored under
+func accountsVerifyCommand(cfg *config, args []string) error {
+	var total, failed int
+
+	err := storage.Accounts().ForEach(func(accountNo string, seed []byte) error {
+		total++
+
+		reason := ""
+		if acct, err := decodeAccount(seed); err != nil {
+			reason = err.Error()
+		} else if acct.AccountNumber() != accountNo && len(seed) == legacyCoreSize {
+			reason = "legacy core derives " + acct.AccountNumber()
+		} else if acct.AccountNumber() != accountNo {
+			reason = "seed derives " + acct.AccountNumber()
+		} else if acct.Network() != bmksdk.GetNetwork() {
+			reason = "account of " + string(acct.Network())
+		}
+
+		if reason != "" {
+			failed++
+			fmt.Printf("%s: %s\n", accountNo, reason)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d accounts failed the verification", failed, total)
+	}
+
+	fmt.Printf("%d accounts verified\n", total)
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	defaultCacheSize  = 512 // MB
+	maxCachedDataKeys = 10000
+)
+
+// contentCache keeps the encrypted content fetched from the asset store
+// on disk so that popular assets are served without refetching them.
+// Only the ciphertext is stored; the data keys are kept in memory only.
+// The least recently used assets are evicted once the total size of the
+// cached content exceeds the limit.
+type contentCache struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	AssetId  string `json:"asset_id"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+var assetCache *contentCache
+
+func newContentCache(dir string, maxSize int64) (*contentCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	cc := &contentCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	if err := cc.load(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// load indexes the cached content, the most recently used first
+func (cc *contentCache) load() error {
+	files, err := ioutil.ReadDir(cc.dir)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		meta, err := ioutil.ReadFile(filepath.Join(cc.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(meta, &entry); err != nil || entry.AssetId == "" || entry.Checksum == "" {
+			assetId := strings.TrimSuffix(f.Name(), ".json")
+			os.Remove(cc.metaPath(assetId))
+			os.Remove(cc.blobPath(assetId))
+			continue
+		}
+
+		cc.entries[entry.AssetId] = cc.lru.PushBack(&entry)
+		cc.size += entry.Size
+	}
+
+	cc.evict()
+	return nil
+}
+
+func (cc *contentCache) blobPath(assetId string) string {
+	return filepath.Join(cc.dir, assetId+".blob")
+}
+
+func (cc *contentCache) metaPath(assetId string) string {
+	return filepath.Join(cc.dir, assetId+".json")
+}
+
+// get returns the cached file name and ciphertext of the asset.
+// Content failing the checksum is dropped. The content is read and
+// checked without holding the lock, so that a large read doesn't hold
+// back the other downloads.
+func (cc *contentCache) get(assetId string) (string, []byte, bool) {
+	if cc == nil {
+		return "", nil, false
+	}
+
+	cc.Lock()
+	elem, ok := cc.entries[assetId]
+	cc.Unlock()
+	if !ok {
+		assetCacheRequests.Inc("miss")
+		return "", nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+
+	data, err := ioutil.ReadFile(cc.blobPath(assetId))
+	valid := err == nil && int64(len(data)) == entry.Size && checksum(data) == entry.Checksum
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	// the content replaced or removed meanwhile isn't served
+	if cc.entries[assetId] != elem {
+		assetCacheRequests.Inc("miss")
+		return "", nil, false
+	}
+	if !valid {
+		assetCacheRequests.Inc("invalid")
+		cc.removeEntry(elem)
+		return "", nil, false
+	}
+
+	assetCacheRequests.Inc("hit")
+	cc.lru.MoveToFront(elem)
+
+	// keep the recency across restarts
+	now := time.Now()
+	os.Chtimes(cc.metaPath(assetId), now, now)
+
+	return entry.FileName, data, true
+}
+
+func (cc *contentCache) put(assetId, fileName string, data []byte) error {
+	if cc == nil || int64(len(data)) > cc.maxSize {
+		return nil
+	}
+
+	entry := &cacheEntry{
+		AssetId:  assetId,
+		FileName: fileName,
+		Size:     int64(len(data)),
+		Checksum: checksum(data),
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	if elem, ok := cc.entries[assetId]; ok {
+		cc.removeEntry(elem)
+	}
+
+	if err := writeFileAtomic(cc.blobPath(assetId), data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(cc.metaPath(assetId), meta); err != nil {
+		os.Remove(cc.blobPath(assetId))
+		return err
+	}
+
+	cc.entries[assetId] = cc.lru.PushFront(entry)
+	cc.size += entry.Size
+	cc.evict()
+	return nil
+}
+
+// remove drops the cached content, e.g. once it is re-encrypted
+func (cc *contentCache) remove(assetId string) {
+	if cc == nil {
+		return
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	if elem, ok := cc.entries[assetId]; ok {
+		cc.removeEntry(elem)
+	}
+}
+
+// Size returns the total size of the cached content
+func (cc *contentCache) Size() int64 {
+	if cc == nil {
+		return 0
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.size
+}
+
+func (cc *contentCache) evict() {
+	for cc.size > cc.maxSize {
+		elem := cc.lru.Back()
+		if elem == nil {
+			return
+		}
+		cc.removeEntry(elem)
+		assetCacheEvictions.Inc()
+	}
+}
+
+func (cc *contentCache) removeEntry(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+
+	cc.lru.Remove(elem)
+	delete(cc.entries, entry.AssetId)
+	cc.size -= entry.Size
+
+	os.Remove(cc.metaPath(entry.AssetId))
+	os.Remove(cc.blobPath(entry.AssetId))
+}
+
+// dataKeyCache keeps the data keys decrypted from the session data in
+// memory, so that the cached content is decrypted without fetching the
+// session data again. A key is held per bitmark and account along with
+// the owner of the bitmark it was shared under, and is served only
+// while the bitmark is held by the same owner.
+type dataKeyCache struct {
+	sync.Mutex
+	maxEntries int
+	lru        *list.List
+	entries    map[string]*list.Element
+}
+
+type dataKeyEntry struct {
+	key       string
+	bitmarkId string
+	assetId   string
+	owner     string
+	dataKey   DataKey
+}
+
+var dataKeys = newDataKeyCache(maxCachedDataKeys)
+
+func newDataKeyCache(maxEntries int) *dataKeyCache {
+	return &dataKeyCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// dataKeyCacheKey identifies the data key shared with the account. The
+// same bitmark id is held under different keys on each network.
+func dataKeyCacheKey(bitmarkId, accountNo string) string {
+	return string(bmksdk.GetNetwork()) + "-" + bitmarkId + "-" + accountNo
+}
+
+// get returns the data key shared with the account, unless the bitmark
+// has changed hands since
+func (kc *dataKeyCache) get(bitmarkId, accountNo, owner string) (DataKey, bool) {
+	kc.Lock()
+	defer kc.Unlock()
+
+	elem, ok := kc.entries[dataKeyCacheKey(bitmarkId, accountNo)]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*dataKeyEntry)
+	if entry.owner != owner {
+		kc.removeEntry(elem)
+		return nil, false
+	}
+
+	kc.lru.MoveToFront(elem)
+	return entry.dataKey, true
+}
+
+func (kc *dataKeyCache) put(bitmarkId, accountNo, owner, assetId string, dataKey DataKey) {
+	kc.Lock()
+	defer kc.Unlock()
+
+	key := dataKeyCacheKey(bitmarkId, accountNo)
+	if elem, ok := kc.entries[key]; ok {
+		kc.removeEntry(elem)
+	}
+
+	kc.entries[key] = kc.lru.PushFront(&dataKeyEntry{
+		key:       key,
+		bitmarkId: bitmarkId,
+		assetId:   assetId,
+		owner:     owner,
+		dataKey:   dataKey,
+	})
+	for kc.lru.Len() > kc.maxEntries {
+		kc.removeEntry(kc.lru.Back())
+	}
+}
+
+// remove drops the data key shared with the account
+func (kc *dataKeyCache) remove(bitmarkId, accountNo string) {
+	kc.Lock()
+	defer kc.Unlock()
+
+	if elem, ok := kc.entries[dataKeyCacheKey(bitmarkId, accountNo)]; ok {
+		kc.removeEntry(elem)
+	}
+}
+
+// removeBitmark drops the data keys of the bitmark, e.g. once it is transferred
+func (kc *dataKeyCache) removeBitmark(bitmarkId string) {
+	kc.removeMatching(func(entry *dataKeyEntry) bool {
+		return entry.bitmarkId == bitmarkId
+	})
+}
+
+// removeAsset drops the data keys of the asset, e.g. once it is re-encrypted
+func (kc *dataKeyCache) removeAsset(assetId string) {
+	kc.removeMatching(func(entry *dataKeyEntry) bool {
+		return entry.assetId == assetId
+	})
+}
+
+func (kc *dataKeyCache) removeMatching(match func(*dataKeyEntry) bool) {
+	kc.Lock()
+	defer kc.Unlock()
+
+	for elem := kc.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*dataKeyEntry)) {
+			kc.removeEntry(elem)
+		}
+		elem = next
+	}
+}
+
+func (kc *dataKeyCache) removeEntry(elem *list.Element) {
+	kc.lru.Remove(elem)
+	delete(kc.entries, elem.Value.(*dataKeyEntry).key)
+}
+
+func checksum(data []byte) string {
+	digest := sha3.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(t *testing.T, maxSize int64) (*contentCache, func()) {
+	dir, err := ioutil.TempDir("", "asset-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := newContentCache(dir, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cc, func() { os.RemoveAll(dir) }
+}
+
+func TestContentCacheGetPut(t *testing.T) {
+	cc, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	_, _, ok := cc.get("a")
+	assert.False(t, ok)
+
+	assert.NoError(t, cc.put("a", "a.txt", []byte("content of a")))
+	name, data, ok := cc.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "a.txt", name)
+	assert.Equal(t, []byte("content of a"), data)
+
+	cc.remove("a")
+	_, _, ok = cc.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), cc.Size())
+}
+
+func TestContentCacheDropsCorruptedContent(t *testing.T) {
+	cc, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	assert.NoError(t, cc.put("a", "a.txt", []byte("content of a")))
+	assert.NoError(t, ioutil.WriteFile(cc.blobPath("a"), []byte("content of b"), 0600))
+
+	_, _, ok := cc.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), cc.Size())
+	_, err := os.Stat(cc.metaPath("a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestContentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cc, cleanup := newTestCache(t, 20)
+	defer cleanup()
+
+	assert.NoError(t, cc.put("a", "a", []byte("0123456789")))
+	assert.NoError(t, cc.put("b", "b", []byte("0123456789")))
+	_, _, ok := cc.get("a")
+	assert.True(t, ok)
+
+	assert.NoError(t, cc.put("c", "c", []byte("0123456789")))
+	_, _, ok = cc.get("b")
+	assert.False(t, ok, "b should be evicted")
+	_, _, ok = cc.get("a")
+	assert.True(t, ok)
+	_, _, ok = cc.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, int64(20), cc.Size())
+
+	// the index is rebuilt from the directory
+	reloaded, err := newContentCache(cc.dir, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), reloaded.Size())
+}
+
+func TestDataKeyCacheEvictsTheLeastRecentlyUsed(t *testing.T) {
+	kc := newDataKeyCache(2)
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kc.put("b1", "alice", "alice", "a1", key)
+	kc.put("b2", "alice", "alice", "a1", key)
+	_, ok := kc.get("b1", "alice", "alice")
+	assert.True(t, ok)
+
+	kc.put("b3", "bob", "bob", "a2", key)
+	_, ok = kc.get("b2", "alice", "alice")
+	assert.False(t, ok)
+	_, ok = kc.get("b1", "alice", "alice")
+	assert.True(t, ok)
+
+	// the key isn't served once the bitmark changes hands
+	_, ok = kc.get("b3", "bob", "carol")
+	assert.False(t, ok)
+
+	kc.put("b3", "bob", "bob", "a2", key)
+	kc.removeAsset("a1")
+	_, ok = kc.get("b1", "alice", "alice")
+	assert.False(t, ok)
+	_, ok = kc.get("b3", "bob", "bob")
+	assert.True(t, ok)
+
+	kc.removeBitmark("b3")
+	_, ok = kc.get("b3", "bob", "bob")
+	assert.False(t, ok)
+}
+
+func TestDataKeyKeptAcrossDownloadsAndTransfers(t *testing.T) {
+	stub, done := useUpstreamStub(t)
+	defer done()
+
+	owner, recipient := stub.newAccount(t), stub.newAccount(t)
+	content := []byte("asset content")
+	a := stub.addAsset(t, owner, content)
+	b := stub.addBitmark(a.Id, owner.AccountNumber())
+
+	load := func(acct account.Account) {
+		loaded, err := loadAsset(context.Background(), acct.AccountNumber(), b.Id)
+		if assert.NoError(t, err) {
+			assert.Equal(t, content, loaded.plaintext)
+		}
+	}
+
+	load(owner)
+	load(owner)
+	assert.Equal(t, 1, stub.accessRequests)
+
+	router := gin.New()
+	router.POST("/transfer", transferBitmark())
+	body := `{"txid": "` + b.LatestTxId + `", "owner": "` + recipient.AccountNumber() + `"}`
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+	req.Header.Set("Content-Type", gin.MIMEJSON)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 1, stub.accessRequests)
+
+	// the previous owner's key is dropped with the transfer
+	loadAsset(context.Background(), owner.AccountNumber(), b.Id)
+	assert.Equal(t, 2, stub.accessRequests)
+
+	load(recipient)
+	load(recipient)
+	assert.Equal(t, 3, stub.accessRequests)
+
+	// the keys are fetched again once the content is re-encrypted
+	_, err := reencryptAsset(context.Background(), a.Id)
+	assert.NoError(t, err)
+	accessRequests := stub.accessRequests
+	load(recipient)
+	assert.Equal(t, accessRequests+1, stub.accessRequests)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+)
+
+const (
+	dispositionAttachment = "attachment"
+	dispositionInline     = "inline"
+)
+
+// assetFile describes the file an asset was issued from
+type assetFile struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+}
+
+func getAssetFileBucketName() []byte {
+	return []byte(fmt.Sprintf("asset-file-%s", string(bmksdk.GetNetwork())))
+}
+
+func newAssetFile(fileName string, content []byte) *assetFile {
+	return &assetFile{
+		FileName: fileName,
+		MimeType: detectMimeType(fileName, content),
+	}
+}
+
+func putAssetFile(assetId string, f *assetFile) error {
+	return storage.AssetFiles().Put(assetId, f)
+}
+
+// getAssetFile returns the file recorded at issue time, or nil for
+// assets issued before the files were recorded
+func getAssetFile(assetId string) (*assetFile, error) {
+	return storage.AssetFiles().Get(assetId)
+}
+
+// detectMimeType prefers the type registered for the file extension and
+// falls back to sniffing the beginning of the content
+func detectMimeType(fileName string, content []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(fileName)); t != "" {
+		return t
+	}
+
+	if len(content) > 512 {
+		content = content[:512]
+	}
+	return http.DetectContentType(content)
+}
+
+// contentDisposition formats the header as specified in RFC 6266. Names
+// which aren't plain ASCII are given as an RFC 5987 encoded filename*
+// parameter, preceded by an ASCII fallback for older clients.
+func contentDisposition(dispositionType, fileName string) string {
+	fileName = sanitizeFileName(fileName)
+	if fileName == "" {
+		return dispositionType
+	}
+
+	fallback := make([]byte, 0, len(fileName))
+	for _, r := range fileName {
+		if r >= 0x80 || r == '"' || r == '\\' {
+			r = '_'
+		}
+		fallback = append(fallback, byte(r))
+	}
+
+	header := fmt.Sprintf(`%s; filename="%s"`, dispositionType, fallback)
+	if string(fallback) != fileName {
+		header += "; filename*=UTF-8''" + encodeRFC5987(fileName)
+	}
+	return header
+}
+
+// sanitizeFileName drops any directory, the control characters
+// and the invalid UTF-8 sequences
+func sanitizeFileName(fileName string) string {
+	fileName = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, fileName)
+
+	fileName = filepath.Base(strings.Replace(fileName, "\\", "/", -1))
+	if fileName == "." || fileName == "/" {
+		return ""
+	}
+	return fileName
+}
+
+// encodeRFC5987 percent-encodes everything but the attr-char set
+func encodeRFC5987(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; isAttrChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
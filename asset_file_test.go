@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentDisposition(t *testing.T) {
+	cases := []struct {
+		fileName string
+		header   string
+	}{
+		{"report.pdf", `attachment; filename="report.pdf"`},
+		{"annual report.pdf", `attachment; filename="annual report.pdf"`},
+		{`say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"résumé.txt", `attachment; filename="r_sum_.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`},
+		{"../../etc/passwd", `attachment; filename="passwd"`},
+		{`C:\Users\me\notes.txt`, `attachment; filename="notes.txt"`},
+		{"evil\r\nSet-Cookie: a=b.txt", `attachment; filename="evilSet-Cookie: a=b.txt"`},
+		{"", "attachment"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.header, contentDisposition(dispositionAttachment, tc.fileName), tc.fileName)
+	}
+
+	assert.Equal(t, `inline; filename="photo.png"`, contentDisposition(dispositionInline, "photo.png"))
+}
+
+func TestDetectMimeType(t *testing.T) {
+	assert.Equal(t, "application/pdf", detectMimeType("report.pdf", []byte("plain text")))
+
+	// sniffed when the extension is unknown
+	png := []byte("\x89PNG\r\n\x1a\n" + string(make([]byte, 1024)))
+	assert.Equal(t, "image/png", detectMimeType("photo", png))
+	assert.Equal(t, "text/plain; charset=utf-8", detectMimeType("notes", []byte("plain text")))
+}
+
+func TestWriteAssetDisposition(t *testing.T) {
+	w := serveTestAsset(dispositionAttachment, []byte("content"), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename="asset.txt"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Empty(t, w.Header().Get("Content-Security-Policy"))
+
+	// the previews are sandboxed
+	w = serveTestAsset(dispositionInline, []byte("content"), nil)
+	assert.Equal(t, `inline; filename="asset.txt"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+}
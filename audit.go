@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	AuditCreateAccount = "create_account"
+	AuditImportAccount = "import_account"
+	AuditExportAccount = "export_account"
+	AuditIssue         = "issue"
+	AuditTransfer      = "transfer"
+	AuditDownload      = "download"
+	AuditDownloadToken = "download_token"
+	AuditRekey         = "rekey"
+	AuditGrant         = "grant"
+	AuditRevoke        = "revoke"
+)
+
+const (
+	auditEntryKey    = "audit-entry"
+	maxAuditPageSize = 1000
+)
+
+// AuditRecord is an entry of the append-only audit log. Every record
+// commits to its predecessor through PrevHash, so altering or removing
+// a record breaks the chain from that point on.
+type AuditRecord struct {
+	Sequence  uint64            `json:"sequence"`
+	Timestamp time.Time         `json:"timestamp"`
+	Action    string            `json:"action"`
+	Caller    string            `json:"caller"`
+	Account   string            `json:"account,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Result    map[string]string `json:"result,omitempty"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+func (r *AuditRecord) computeHash() (string, error) {
+	aux := *r
+	aux.Hash = ""
+
+	data, err := json.Marshal(&aux)
+	if err != nil {
+		return "", err
+	}
+	digest := sha3.Sum256(data)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+func getAuditBucketName() []byte {
+	return []byte(fmt.Sprintf("audit-%s", string(bmksdk.GetNetwork())))
+}
+
+// appendAuditRecord chains the record to the last one and stores it
+func appendAuditRecord(r *AuditRecord) error {
+	return storage.Audit().Append(r)
+}
+
+// listAuditRecords returns the records after the given sequence number
+func listAuditRecords(after uint64, limit int, account, action string) ([]*AuditRecord, error) {
+	return storage.Audit().List(after, limit, account, action)
+}
+
+type auditVerification struct {
+	Valid    bool   `json:"valid"`
+	Records  uint64 `json:"records"`
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// errChainBroken stops the verification at the first broken record
+var errChainBroken = errors.New("audit chain broken")
+
+// verifyAuditChain recomputes the hash of every record and checks
+// that the records are contiguous and linked to their predecessors
+func verifyAuditChain() (*auditVerification, error) {
+	result := &auditVerification{Valid: true}
+
+	var prevHash string
+	var expected uint64 = 1
+
+	err := storage.Audit().ForEach(func(seq uint64, v []byte) error {
+		fail := func(reason string) error {
+			result.Valid = false
+			result.BrokenAt = seq
+			result.Reason = reason
+			return errChainBroken
+		}
+
+		var r AuditRecord
+		if err := json.Unmarshal(v, &r); err != nil {
+			return fail(fmt.Sprintf("malformed record: %s", err))
+		}
+		if seq != expected || r.Sequence != seq {
+			return fail(fmt.Sprintf("expected sequence %d", expected))
+		}
+		if r.PrevHash != prevHash {
+			return fail("previous hash mismatch")
+		}
+		hash, err := r.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != r.Hash {
+			return fail("record hash mismatch")
+		}
+
+		result.Records++
+		prevHash = r.Hash
+		expected++
+		return nil
+	})
+	if err != nil && err != errChainBroken {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// callerIdentity identifies the client on whose behalf the request runs,
+// by its certificate when it presented one, otherwise by its address
+func callerIdentity(c *gin.Context) string {
+	if identity, ok := certificateIdentity(c); ok {
+		return identity
+	}
+	return clientAddress(c.Request)
+}
+
+// auditAction records the request in the audit log once the handler
+// has completed. Handlers add details with auditAccount, auditParam
+// and auditResult.
+func auditAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := &AuditRecord{
+			Action: action,
+			Caller: callerIdentity(c),
+			Params: make(map[string]string),
+			Result: make(map[string]string),
+		}
+		c.Set(auditEntryKey, r)
+
+		c.Next()
+
+		r.Timestamp = time.Now().UTC()
+		r.Status = "success"
+		if c.Writer.Status() >= 400 {
+			r.Status = "failure"
+			if e := c.Errors.Last(); e != nil {
+				r.Error = e.Error()
+			}
+		}
+
+		if err := appendAuditRecord(r); err != nil {
+			log.Criticalf("failed to write the audit record of %s: %s", action, err)
+		}
+	}
+}
+
+// auditCommand records an operation run from the command line
+func auditCommand(action, accountNo string, params map[string]string, err error) {
+	r := &AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+		Caller:    "cli",
+		Account:   accountNo,
+		Params:    params,
+		Status:    "success",
+	}
+	if err != nil {
+		r.Status = "failure"
+		r.Error = err.Error()
+	}
+
+	if err := appendAuditRecord(r); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write the audit record of %s: %s\n", action, err)
+	}
+}
+
+func auditEntry(c *gin.Context) *AuditRecord {
+	if v, ok := c.Get(auditEntryKey); ok {
+		return v.(*AuditRecord)
+	}
+	return nil
+}
+
+func auditAccount(c *gin.Context, accountNo string) {
+	if r := auditEntry(c); r != nil {
+		r.Account = accountNo
+	}
+}
+
+func auditParam(c *gin.Context, key, value string) {
+	if r := auditEntry(c); r != nil {
+		r.Params[key] = value
+	}
+}
+
+func auditResult(c *gin.Context, key, value string) {
+	if r := auditEntry(c); r != nil {
+		r.Result[key] = value
+	}
+}
+
+func listAudit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		after, err := strconv.ParseUint(c.DefaultQuery("after", "0"), 10, 64)
+		if err != nil {
+			abortWithError(c, validationError("after must be a sequence number"))
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			abortWithError(c, validationError("limit must be between 1 and %d", maxAuditPageSize))
+			return
+		}
+
+		records, err := listAuditRecords(after, limit, c.Query("account"), c.Query("action"))
+		if err != nil {
+			abortWithError(c, internalError("failed to read the audit log: %s", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"records": records})
+	}
+}
+
+func verifyAudit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := verifyAuditChain()
+		if err != nil {
+			abortWithError(c, internalError("failed to verify the audit log: %s", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+func auditListCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("audit list", flag.ExitOnError)
+	after := fs.Uint64("after", 0, "list the records after this sequence number")
+	limit := fs.Int("limit", 100, "maximum number of records")
+	account := fs.String("account", "", "only list the records of this account")
+	action := fs.String("action", "", "only list the records of this action")
+	fs.Parse(args)
+
+	records, err := listAuditRecords(*after, *limit, *account, *action)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func auditVerifyCommand(cfg *config, args []string) error {
+	result, err := verifyAuditChain()
+	if err != nil {
+		return err
+	}
+
+	if !result.Valid {
+		return fmt.Errorf("audit chain broken at record %d: %s", result.BrokenAt, result.Reason)
+	}
+
+	fmt.Printf("audit chain valid: %d records\n", result.Records)
+	return nil
+}
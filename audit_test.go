@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func appendTestAuditRecords(t *testing.T, actions ...string) {
+	for _, action := range actions {
+		if err := appendAuditRecord(&AuditRecord{Action: action, Status: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	result, err := verifyAuditChain()
+	assert.NoError(t, err)
+	assert.Equal(t, &auditVerification{Valid: true}, result)
+
+	appendTestAuditRecords(t, AuditCreateAccount, AuditIssue, AuditTransfer)
+
+	result, err = verifyAuditChain()
+	assert.NoError(t, err)
+	assert.Equal(t, &auditVerification{Valid: true, Records: 3}, result)
+}
+
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	tamper := func(fn func(b *bolt.Bucket) error) *auditVerification {
+		defer openTestBoltStorage(t)()
+		appendTestAuditRecords(t, AuditCreateAccount, AuditIssue, AuditTransfer)
+
+		assert.NoError(t, updateDB(func(tx *bolt.Tx) error {
+			return fn(tx.Bucket(getAuditBucketName()))
+		}))
+
+		result, err := verifyAuditChain()
+		assert.NoError(t, err)
+		return result
+	}
+	rewrite := func(seq uint64, change func(r *AuditRecord)) func(b *bolt.Bucket) error {
+		return func(b *bolt.Bucket) error {
+			var r AuditRecord
+			if err := json.Unmarshal(b.Get(auditKey(seq)), &r); err != nil {
+				return err
+			}
+			change(&r)
+			data, err := json.Marshal(&r)
+			if err != nil {
+				return err
+			}
+			return b.Put(auditKey(seq), data)
+		}
+	}
+
+	result := tamper(rewrite(2, func(r *AuditRecord) { r.Caller = "someone else" }))
+	assert.Equal(t, &auditVerification{BrokenAt: 2, Records: 1, Reason: "record hash mismatch"}, result)
+
+	// rehashing the altered record breaks the link of its successor
+	result = tamper(rewrite(2, func(r *AuditRecord) {
+		r.Caller = "someone else"
+		r.Hash, _ = r.computeHash()
+	}))
+	assert.Equal(t, &auditVerification{BrokenAt: 3, Records: 2, Reason: "previous hash mismatch"}, result)
+
+	result = tamper(func(b *bolt.Bucket) error { return b.Delete(auditKey(2)) })
+	assert.Equal(t, &auditVerification{BrokenAt: 3, Records: 1, Reason: "expected sequence 2"}, result)
+
+	result = tamper(func(b *bolt.Bucket) error { return b.Put(auditKey(3), []byte("{")) })
+	assert.False(t, result.Valid)
+	assert.Equal(t, uint64(3), result.BrokenAt)
+}
+
+func TestAuditActionRecordsTheOutcome(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	r := gin.New()
+	r.POST("/transfer", auditAction(AuditTransfer), func(c *gin.Context) {
+		auditAccount(c, "owner")
+		auditParam(c, "bitmark_id", "b")
+		auditResult(c, "txid", "t")
+		c.Status(http.StatusOK)
+	})
+	r.POST("/issue", auditAction(AuditIssue), func(c *gin.Context) {
+		auditAccount(c, "registrant")
+		abortWithError(c, validationError("invalid request"))
+	})
+
+	for _, path := range []string{"/transfer", "/issue"} {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	records, err := listAuditRecords(0, 10, "", "")
+	assert.NoError(t, err)
+	if !assert.Len(t, records, 2) {
+		return
+	}
+
+	assert.Equal(t, AuditTransfer, records[0].Action)
+	assert.Equal(t, "192.0.2.1", records[0].Caller)
+	assert.Equal(t, "owner", records[0].Account)
+	assert.Equal(t, map[string]string{"bitmark_id": "b"}, records[0].Params)
+	assert.Equal(t, map[string]string{"txid": "t"}, records[0].Result)
+	assert.Equal(t, "success", records[0].Status)
+	assert.Empty(t, records[0].Error)
+	assert.False(t, records[0].Timestamp.IsZero())
+
+	assert.Equal(t, AuditIssue, records[1].Action)
+	assert.Equal(t, "failure", records[1].Status)
+	assert.Equal(t, "invalid request", records[1].Error)
+}
+
+func TestListAudit(t *testing.T) {
+	defer openTestBoltStorage(t)()
+	appendTestAuditRecords(t, AuditIssue, AuditTransfer, AuditIssue)
+
+	list := func(query string) (int, []*AuditRecord) {
+		r := gin.New()
+		r.GET("/audit", listAudit())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/audit"+query, nil))
+
+		var body struct {
+			Records []*AuditRecord `json:"records"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Records
+	}
+
+	code, records := list("?action=issue&after=1")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, uint64(3), records[0].Sequence)
+	}
+
+	code, records = list("?limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, records, 2)
+
+	code, _ = list("?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("?after=-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Asset content is framed as magic || version || nonce || sealed content.
+// The header is authenticated together with the asset id, so the content
+// can neither be downgraded nor moved to another asset.
+//
+// Content without the header was sealed with an all-zero nonce before the
+// framing was introduced. It is only accepted under the chacha20poly1305
+// algorithm, the one it was uploaded with.
+const (
+	ciphertextVersion1 = 0x01
+)
+
+var (
+	ciphertextMagic = []byte("BTE")
+
+	errCiphertextTooShort = errors.New("ciphertext too short")
+)
+
+func ciphertextHeader(version byte) []byte {
+	return append(append([]byte{}, ciphertextMagic...), version)
+}
+
+func hasCiphertextHeader(ciphertext []byte) bool {
+	return len(ciphertext) > len(ciphertextMagic) && bytes.HasPrefix(ciphertext, ciphertextMagic)
+}
+
+// sealFramed encrypts the plaintext under a random nonce
+func sealFramed(aead cipher.AEAD, plaintext, assetId []byte) ([]byte, error) {
+	header := ciphertextHeader(ciphertextVersion1)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, append(header, assetId...)), nil
+}
+
+// openFramed decrypts the content produced by sealFramed
+func openFramed(aead cipher.AEAD, ciphertext, assetId []byte) ([]byte, error) {
+	headerSize := len(ciphertextMagic) + 1
+	if len(ciphertext) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, errCiphertextTooShort
+	}
+
+	header := ciphertext[:headerSize]
+	if header[len(ciphertextMagic)] != ciphertextVersion1 {
+		return nil, errors.New("unsupported ciphertext version")
+	}
+
+	nonce := ciphertext[headerSize : headerSize+aead.NonceSize()]
+	sealed := ciphertext[headerSize+aead.NonceSize():]
+
+	return aead.Open(nil, nonce, sealed, append(append([]byte{}, header...), assetId...))
+}
+
+// openLegacy decrypts the content sealed with an all-zero nonce
+func openLegacy(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+const (
+	xchacha20NonceSize = 24
+	poly1305TagSize    = 16
+)
+
+// xchacha20poly1305 is the extended nonce variant of ChaCha20-Poly1305.
+// The 192-bit nonce is large enough to be picked at random.
+type xchacha20poly1305 struct {
+	key []byte
+}
+
+func newXChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, errors.New("xchacha20poly1305: bad key length")
+	}
+	return &xchacha20poly1305{key: key}, nil
+}
+
+func (x *xchacha20poly1305) NonceSize() int {
+	return xchacha20NonceSize
+}
+
+func (x *xchacha20poly1305) Overhead() int {
+	return poly1305TagSize
+}
+
+// aead derives the subkey from the first 16 bytes of the nonce and returns
+// the ChaCha20-Poly1305 nonce made of the remaining 8 bytes
+func (x *xchacha20poly1305) aead(nonce []byte) (cipher.AEAD, []byte, error) {
+	if len(nonce) != xchacha20NonceSize {
+		return nil, nil, errors.New("xchacha20poly1305: bad nonce length")
+	}
+
+	subkey := hchacha20(x.key, nonce[:16])
+	aead, err := chacha20poly1305.New(subkey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chachaNonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(chachaNonce[4:], nonce[16:])
+	return aead, chachaNonce, nil
+}
+
+func (x *xchacha20poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	aead, chachaNonce, err := x.aead(nonce)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(dst, chachaNonce, plaintext, additionalData)
+}
+
+func (x *xchacha20poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, chachaNonce, err := x.aead(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(dst, chachaNonce, ciphertext, additionalData)
+}
+
+// hchacha20 derives a 256-bit subkey from the key and a 128-bit nonce
+func hchacha20(key, nonce []byte) []byte {
+	var s [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	for i := 0; i < 4; i++ {
+		s[12+i] = binary.LittleEndian.Uint32(nonce[i*4:])
+	}
+
+	quarterRound := func(a, b, c, d int) {
+		s[a] += s[b]
+		s[d] ^= s[a]
+		s[d] = s[d]<<16 | s[d]>>16
+		s[c] += s[d]
+		s[b] ^= s[c]
+		s[b] = s[b]<<12 | s[b]>>20
+		s[a] += s[b]
+		s[d] ^= s[a]
+		s[d] = s[d]<<8 | s[d]>>24
+		s[c] += s[d]
+		s[b] ^= s[c]
+		s[b] = s[b]<<7 | s[b]>>25
+	}
+
+	for i := 0; i < 10; i++ {
+		quarterRound(0, 4, 8, 12)
+		quarterRound(1, 5, 9, 13)
+		quarterRound(2, 6, 10, 14)
+		quarterRound(3, 7, 11, 15)
+		quarterRound(0, 5, 10, 15)
+		quarterRound(1, 6, 11, 12)
+		quarterRound(2, 7, 8, 13)
+		quarterRound(3, 4, 9, 14)
+	}
+
+	out := make([]byte, 32)
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint32(out[i*4:], s[i])
+		binary.LittleEndian.PutUint32(out[16+i*4:], s[12+i])
+	}
+	return out
+}
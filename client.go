@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// exit statuses of the client commands, one for each error class
+// returned by the service
+const (
+	exitFailure             = 1
+	exitUsage               = 2
+	exitValidation          = 3
+	exitNotFound            = 4
+	exitNotCustodial        = 5
+	exitUpstreamUnavailable = 6
+	exitUpstreamRejected    = 7
+	exitCryptoFailure       = 8
+	exitIntegrityFailure    = 9
+	exitInternal            = 10
+	exitUnreachable         = 11
+	exitRateLimited         = 12
+)
+
+var errorExitStatus = map[ErrorCode]int{
+	ErrCodeValidation:          exitValidation,
+	ErrCodeNotFound:            exitNotFound,
+	ErrCodeNotCustodial:        exitNotCustodial,
+	ErrCodeUpstreamUnavailable: exitUpstreamUnavailable,
+	ErrCodeUpstreamRejected:    exitUpstreamRejected,
+	ErrCodeCryptoFailure:       exitCryptoFailure,
+	ErrCodeIntegrityFailure:    exitIntegrityFailure,
+	ErrCodeInternal:            exitInternal,
+	ErrCodeRateLimited:         exitRateLimited,
+	ErrCodeQuotaExceeded:       exitRateLimited,
+}
+
+// exitError carries the exit status of a failed command
+type exitError struct {
+	status int
+	err    error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// apiError is the error body returned by the service
+type apiError struct {
+	Message      string            `json:"error"`
+	Code         ErrorCode         `json:"code"`
+	UpstreamCode int               `json:"upstream_code"`
+	Fields       map[string]string `json:"fields"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Code, e.Message)
+	if e.UpstreamCode != 0 {
+		msg += fmt.Sprintf(" (upstream code %d)", e.UpstreamCode)
+	}
+
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg += fmt.Sprintf("\n  %s: %s", name, e.Fields[name])
+	}
+	return msg
+}
+
+// apiClient calls the endpoints of a running service
+type apiClient struct {
+	server string
+	output string
+	client *http.Client
+
+	// files to verify the service and to authenticate to it
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+// newClientFlags returns the flag set of a client command
+// with the options shared by all of them
+func newClientFlags(name string, cfg *config) (*flag.FlagSet, *apiClient) {
+	server := os.Getenv("BITMARK_TRADE_SERVER")
+	if server == "" {
+		port := cfg.Port
+		if port == 0 {
+			port = 8080
+		}
+		server = fmt.Sprintf("http://localhost:%d", port)
+	}
+
+	ac := &apiClient{client: &http.Client{}}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&ac.server, "server", server, "URL of the service, defaults to $BITMARK_TRADE_SERVER")
+	fs.StringVar(&ac.output, "output", "table", "output format: table or json")
+	fs.StringVar(&ac.caFile, "cacert", os.Getenv("BITMARK_TRADE_CACERT"), "CA bundle to verify the service, defaults to $BITMARK_TRADE_CACERT")
+	fs.StringVar(&ac.certFile, "cert", os.Getenv("BITMARK_TRADE_CERT"), "client certificate, defaults to $BITMARK_TRADE_CERT")
+	fs.StringVar(&ac.keyFile, "key", os.Getenv("BITMARK_TRADE_KEY"), "key of the client certificate, defaults to $BITMARK_TRADE_KEY")
+	return fs, ac
+}
+
+// parse parses the arguments and checks the required flags
+func (ac *apiClient) parse(fs *flag.FlagSet, args []string, required ...string) error {
+	fs.Parse(args)
+
+	if ac.output != "table" && ac.output != "json" {
+		return &exitError{exitUsage, fmt.Errorf("-output must be table or json")}
+	}
+
+	for _, name := range required {
+		if f := fs.Lookup(name); f != nil && f.Value.String() == "" {
+			return &exitError{exitUsage, fmt.Errorf("-%s is required", name)}
+		}
+	}
+
+	if err := ac.setupTLS(); err != nil {
+		return &exitError{exitUsage, err}
+	}
+	return nil
+}
+
+// setupTLS configures the CA bundle and the client certificate given
+func (ac *apiClient) setupTLS() error {
+	if ac.caFile == "" && ac.certFile == "" && ac.keyFile == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if ac.caFile != "" {
+		pem, err := ioutil.ReadFile(ac.caFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", ac.caFile)
+		}
+	}
+
+	if ac.certFile != "" || ac.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(ac.certFile, ac.keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	ac.client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	return nil
+}
+
+func (ac *apiClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, &exitError{exitUnreachable, err}
+	}
+
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e apiError
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Code == "" {
+		return nil, &exitError{exitFailure, fmt.Errorf("unexpected response: %s", resp.Status)}
+	}
+
+	status, ok := errorExitStatus[e.Code]
+	if !ok {
+		status = exitFailure
+	}
+	return nil, &exitError{status, &e}
+}
+
+// call sends the JSON encoded body and decodes the response into out
+func (ac *apiClient) call(method, path string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ac.server+path, r)
+	if err != nil {
+		return &exitError{exitUsage, err}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ac.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// print writes the result as indented JSON or as a table
+func (ac *apiClient) print(result interface{}, header []string, rows ...[]string) error {
+	if ac.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// metadataFlag collects repeated -metadata key=value flags
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	return compactMetadata(m)
+}
+
+func (m metadataFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value")
+	}
+	m[parts[0]] = parts[1]
+	return nil
+}
+
+func clientAccountCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client account", cfg)
+	if err := ac.parse(fs, args); err != nil {
+		return err
+	}
+
+	var result struct {
+		Account string `json:"account"`
+	}
+	if err := ac.call("POST", "/v1/account", nil, &result); err != nil {
+		return err
+	}
+
+	return ac.print(result, []string{"ACCOUNT"}, []string{result.Account})
+}
+
+func clientIssueCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client issue", cfg)
+	registrant := fs.String("registrant", "", "account number of the registrant")
+	name := fs.String("name", "", "name of the asset")
+	quantity := fs.Int("quantity", 1, "number of bitmarks to issue")
+	file := fs.String("file", "", "upload this file as the asset content")
+	assetURL := fs.String("asset-url", "", "path of the asset content on the service host")
+	metadata := metadataFlag{}
+	fs.Var(metadata, "metadata", "key=value metadata of the asset, repeatable")
+	if err := ac.parse(fs, args, "registrant", "name"); err != nil {
+		return err
+	}
+	if (*file == "") == (*assetURL == "") {
+		return &exitError{exitUsage, fmt.Errorf("either -file or -asset-url is required")}
+	}
+
+	var result struct {
+		BitmarkIds []string `json:"bitmark_ids"`
+	}
+	if *assetURL != "" {
+		req := issueRequest{
+			AssetURL:   *assetURL,
+			Registrant: *registrant,
+			Name:       *name,
+			Metadata:   metadata,
+			Quantity:   *quantity,
+		}
+		if err := ac.call("POST", "/v1/issue", &req, &result); err != nil {
+			return err
+		}
+	} else {
+		if err := ac.upload(*file, *registrant, *name, *quantity, metadata, &result); err != nil {
+			return err
+		}
+	}
+
+	rows := make([][]string, len(result.BitmarkIds))
+	for i, id := range result.BitmarkIds {
+		rows[i] = []string{id}
+	}
+	return ac.print(result, []string{"BITMARK ID"}, rows...)
+}
+
+// upload streams the file to the issue endpoint as a multipart form
+func (ac *apiClient) upload(path, registrant, name string, quantity int, metadata map[string]string, out interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return &exitError{exitUsage, err}
+	}
+	defer f.Close()
+
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		fields := [][2]string{
+			{"registrant", registrant},
+			{"name", name},
+			{"quantity", strconv.Itoa(quantity)},
+			{"metadata", string(meta)},
+		}
+		for _, field := range fields {
+			if err := form.WriteField(field[0], field[1]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := form.CreateFormFile("file", filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest("POST", ac.server+"/v1/issue", pr)
+	if err != nil {
+		return &exitError{exitUsage, err}
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := ac.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func clientTransferCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client transfer", cfg)
+	txId := fs.String("txid", "", "id of the transaction holding the bitmark")
+	owner := fs.String("owner", "", "account number of the next owner")
+	if err := ac.parse(fs, args, "txid", "owner"); err != nil {
+		return err
+	}
+
+	var result struct {
+		TxId string `json:"txid"`
+	}
+	req := transferRequest{TxId: *txId, NextOnwer: *owner}
+	if err := ac.call("POST", "/v1/transfer", &req, &result); err != nil {
+		return err
+	}
+
+	return ac.print(result, []string{"TXID"}, []string{result.TxId})
+}
+
+func clientDownloadCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client download", cfg)
+	accountNo := fs.String("account", "", "account number of the owner")
+	bitmarkId := fs.String("bitmark", "", "id of the bitmark")
+	token := fs.String("token", "", "download token, instead of -account and -bitmark")
+	out := fs.String("out", ".", "file or directory to save the content to")
+	if err := ac.parse(fs, args); err != nil {
+		return err
+	}
+
+	var path string
+	switch {
+	case *token != "":
+		path = "/downloads/" + url.PathEscape(*token)
+	case *accountNo != "" && *bitmarkId != "":
+		path = "/v1/assets/" + url.PathEscape(*accountNo) + "/" + url.PathEscape(*bitmarkId)
+	default:
+		return &exitError{exitUsage, fmt.Errorf("either -token or -account and -bitmark are required")}
+	}
+
+	req, err := http.NewRequest("GET", ac.server+path, nil)
+	if err != nil {
+		return &exitError{exitUsage, err}
+	}
+	resp, err := ac.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	target := *out
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		target = filepath.Join(target, downloadFileName(resp))
+	}
+
+	size, err := saveFile(target, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		File        string `json:"file"`
+		Size        int64  `json:"size"`
+		Fingerprint string `json:"fingerprint"`
+	}{target, size, resp.Header.Get("X-Content-Fingerprint")}
+	return ac.print(result, []string{"FILE", "SIZE", "FINGERPRINT"},
+		[]string{result.File, strconv.FormatInt(result.Size, 10), result.Fingerprint})
+}
+
+// downloadFileName returns the file name given by the Content-Disposition header
+func downloadFileName(resp *http.Response) string {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil {
+		if name := sanitizeFileName(params["filename"]); name != "" {
+			return name
+		}
+	}
+	return "download"
+}
+
+// saveFile writes the content to a temporary file next to the path
+// and moves it in place once complete
+func saveFile(path string, r io.Reader) (int64, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".download-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	size, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return size, os.Rename(f.Name(), path)
+}
+
+func clientTokenCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client token", cfg)
+	accountNo := fs.String("account", "", "account number of the owner")
+	bitmarkId := fs.String("bitmark", "", "id of the bitmark")
+	ttl := fs.Int("ttl", defaultTokenTTL, "validity of the token in seconds")
+	oneTime := fs.Bool("one-time", false, "accept the token only once")
+	if err := ac.parse(fs, args, "account", "bitmark"); err != nil {
+		return err
+	}
+
+	var result struct {
+		Token     string    `json:"token"`
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	req := downloadTokenRequest{Account: *accountNo, BitmarkId: *bitmarkId, TTL: *ttl, OneTime: *oneTime}
+	if err := ac.call("POST", "/v1/downloads", &req, &result); err != nil {
+		return err
+	}
+
+	return ac.print(result, []string{"TOKEN", "EXPIRES AT"},
+		[]string{result.Token, result.ExpiresAt.Format(time.RFC3339)})
+}
+
+func clientRekeyCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client rekey", cfg)
+	assetId := fs.String("asset", "", "id of the asset")
+	if err := ac.parse(fs, args, "asset"); err != nil {
+		return err
+	}
+
+	var result rekeyResult
+	if err := ac.call("POST", "/v1/assets/"+url.PathEscape(*assetId)+"/rekey", nil, &result); err != nil {
+		return err
+	}
+
+	return ac.print(result, []string{"ASSET ID", "ALGORITHM", "BITMARKS"},
+		[]string{result.AssetId, result.Algorithm, strings.Join(result.Bitmarks, ",")})
+}
+
+func clientGrantCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client grant", cfg)
+	bitmarkId := fs.String("bitmark", "", "id of the bitmark")
+	grantee := fs.String("grantee", "", "account number of the grantee")
+	if err := ac.parse(fs, args, "bitmark", "grantee"); err != nil {
+		return err
+	}
+
+	var result Grant
+	req := grantRequest{Grantee: *grantee}
+	if err := ac.call("POST", "/v1/bitmarks/"+url.PathEscape(*bitmarkId)+"/grants", &req, &result); err != nil {
+		return err
+	}
+
+	return ac.print(result, grantHeader, grantRow(&result))
+}
+
+func clientGrantsCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client grants", cfg)
+	bitmarkId := fs.String("bitmark", "", "id of the bitmark")
+	if err := ac.parse(fs, args, "bitmark"); err != nil {
+		return err
+	}
+
+	var result struct {
+		Grants []*Grant `json:"grants"`
+	}
+	if err := ac.call("GET", "/v1/bitmarks/"+url.PathEscape(*bitmarkId)+"/grants", nil, &result); err != nil {
+		return err
+	}
+
+	rows := make([][]string, len(result.Grants))
+	for i, g := range result.Grants {
+		rows[i] = grantRow(g)
+	}
+	return ac.print(result, grantHeader, rows...)
+}
+
+var grantHeader = []string{"BITMARK ID", "OWNER", "GRANTEE", "CREATED AT"}
+
+func grantRow(g *Grant) []string {
+	return []string{g.BitmarkId, g.Owner, g.Grantee, g.CreatedAt.Format(time.RFC3339)}
+}
+
+func clientRevokeCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client revoke", cfg)
+	bitmarkId := fs.String("bitmark", "", "id of the bitmark")
+	grantee := fs.String("grantee", "", "account number of the grantee")
+	if err := ac.parse(fs, args, "bitmark", "grantee"); err != nil {
+		return err
+	}
+
+	var result struct {
+		Revoked string `json:"revoked"`
+	}
+	path := "/v1/bitmarks/" + url.PathEscape(*bitmarkId) + "/grants/" + url.PathEscape(*grantee)
+	if err := ac.call("DELETE", path, nil, &result); err != nil {
+		return err
+	}
+
+	return ac.print(result, []string{"REVOKED"}, []string{result.Revoked})
+}
+
+func clientAuditCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client audit", cfg)
+	after := fs.Uint64("after", 0, "list the records after this sequence number")
+	limit := fs.Int("limit", 100, "maximum number of records")
+	accountNo := fs.String("account", "", "only list the records of this account")
+	action := fs.String("action", "", "only list the records of this action")
+	if err := ac.parse(fs, args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("after", strconv.FormatUint(*after, 10))
+	query.Set("limit", strconv.Itoa(*limit))
+	if *accountNo != "" {
+		query.Set("account", *accountNo)
+	}
+	if *action != "" {
+		query.Set("action", *action)
+	}
+
+	var result struct {
+		Records []*AuditRecord `json:"records"`
+	}
+	if err := ac.call("GET", "/v1/audit?"+query.Encode(), nil, &result); err != nil {
+		return err
+	}
+
+	rows := make([][]string, len(result.Records))
+	for i, r := range result.Records {
+		rows[i] = []string{
+			strconv.FormatUint(r.Sequence, 10),
+			r.Timestamp.Format(time.RFC3339),
+			r.Action,
+			r.Caller,
+			r.Account,
+			r.Status,
+		}
+	}
+	return ac.print(result, []string{"SEQUENCE", "TIMESTAMP", "ACTION", "CALLER", "ACCOUNT", "STATUS"}, rows...)
+}
+
+func clientAuditVerifyCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client audit-verify", cfg)
+	if err := ac.parse(fs, args); err != nil {
+		return err
+	}
+
+	var result auditVerification
+	if err := ac.call("GET", "/v1/audit/verify", nil, &result); err != nil {
+		return err
+	}
+
+	if err := ac.print(result, []string{"VALID", "RECORDS", "BROKEN AT", "REASON"}, []string{
+		strconv.FormatBool(result.Valid),
+		strconv.FormatUint(result.Records, 10),
+		strconv.FormatUint(result.BrokenAt, 10),
+		result.Reason,
+	}); err != nil {
+		return err
+	}
+
+	if !result.Valid {
+		return &exitError{exitIntegrityFailure, fmt.Errorf("audit chain broken at record %d", result.BrokenAt)}
+	}
+	return nil
+}
+
+func clientStatusCommand(cfg *config, args []string) error {
+	fs, ac := newClientFlags("client status", cfg)
+	if err := ac.parse(fs, args); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", ac.server+"/readyz", nil)
+	if err != nil {
+		return &exitError{exitUsage, err}
+	}
+
+	// the probe answers 503 with the same body when a dependency is down
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return &exitError{exitUnreachable, err}
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status       string                      `json:"status"`
+		Dependencies map[string]dependencyStatus `json:"dependencies"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &exitError{exitFailure, fmt.Errorf("unexpected response: %s", resp.Status)}
+	}
+
+	names := make([]string, 0, len(result.Dependencies))
+	for name := range result.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]string, len(names))
+	for i, name := range names {
+		d := result.Dependencies[name]
+		rows[i] = []string{name, d.Status, d.Latency, d.Error}
+	}
+	if err := ac.print(result, []string{"DEPENDENCY", "STATUS", "LATENCY", "ERROR"}, rows...); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &exitError{exitUpstreamUnavailable, fmt.Errorf("service not ready: %s", result.Status)}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// clientExitStatus returns the exit status of a call answered with the error
+func clientExitStatus(t *testing.T, err error) int {
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) { abortWithError(c, err) })
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ac := &apiClient{server: server.URL, client: &http.Client{}}
+	callErr := ac.call("GET", "/", nil, nil)
+	e, ok := callErr.(*exitError)
+	if !assert.True(t, ok, "%v", callErr) {
+		return 0
+	}
+	return e.status
+}
+
+func TestClientExitStatusFollowsTheErrorClass(t *testing.T) {
+	for code, status := range errorExitStatus {
+		assert.Equal(t, status, clientExitStatus(t, newError(code, "failed")), string(code))
+	}
+	assert.Equal(t, exitInternal, clientExitStatus(t, errors.New("disk full")))
+	assert.Equal(t, exitFailure, clientExitStatus(t, newError(ErrorCode("unknown"), "failed")))
+}
+
+func TestClientReportsTheServiceError(t *testing.T) {
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		e := validationError("invalid request")
+		e.Fields = map[string]string{"quantity": "must be positive", "name": "is required"}
+		abortWithError(c, e)
+	})
+	r.GET("/plain", func(c *gin.Context) { c.String(http.StatusBadGateway, "bad gateway") })
+	server := httptest.NewServer(r)
+
+	ac := &apiClient{server: server.URL, client: &http.Client{}}
+	err := ac.call("GET", "/", nil, nil)
+	assert.EqualError(t, err, "validation_error: invalid request\n  name: is required\n  quantity: must be positive")
+
+	// a response which isn't one of the service
+	err = ac.call("GET", "/plain", nil, nil)
+	assert.Equal(t, exitFailure, err.(*exitError).status)
+	assert.EqualError(t, err, "unexpected response: 502 Bad Gateway")
+
+	server.Close()
+	err = ac.call("GET", "/", nil, nil)
+	assert.Equal(t, exitUnreachable, err.(*exitError).status)
+}
+
+func TestDownloadFileName(t *testing.T) {
+	name := func(disposition string) string {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Content-Disposition", disposition)
+		return downloadFileName(resp)
+	}
+
+	assert.Equal(t, "report.pdf", name(`attachment; filename="report.pdf"`))
+	assert.Equal(t, "résumé.txt", name(contentDisposition(dispositionAttachment, "résumé.txt")))
+	assert.Equal(t, "passwd", name(`attachment; filename="../../etc/passwd"`))
+	assert.Equal(t, "download", name("attachment"))
+	assert.Equal(t, "download", name(""))
+}
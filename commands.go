@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is an offline operation run against the database
+// instead of starting the service. Remote commands call the
+// endpoints of a running service instead.
+type command struct {
+	usage  string
+	run    func(cfg *config, args []string) error
+	remote bool
+}
+
+const clientOptions = "[-server url] [-output table|json] [-cacert path] [-cert path -key path]"
+
+var commands = map[string]command{
+	"accounts list":   {"accounts list", accountsListCommand, false},
+	"accounts show":   {"accounts show [-seed] number", accountsShowCommand, false},
+	"accounts import": {"accounts import [-seed seed] [-register=false]", accountsImportCommand, false},
+	"accounts verify": {"accounts verify", accountsVerifyCommand, false},
+	"db stats":        {"db stats", dbStatsCommand, false},
+	"db migrate":      {"db migrate [-dry-run]", dbMigrateCommand, false},
+
+	"audit list":   {"audit list [-after sequence] [-limit count] [-account number] [-action name]", auditListCommand, false},
+	"audit verify": {"audit verify", auditVerifyCommand, false},
+
+	"client account":      {"client account " + clientOptions, clientAccountCommand, true},
+	"client issue":        {"client issue -registrant number -name name (-file path | -asset-url path) [-quantity count] [-metadata key=value]... " + clientOptions, clientIssueCommand, true},
+	"client transfer":     {"client transfer -txid id -owner number " + clientOptions, clientTransferCommand, true},
+	"client download":     {"client download (-token token | -account number -bitmark id) [-out path] " + clientOptions, clientDownloadCommand, true},
+	"client token":        {"client token -account number -bitmark id [-ttl seconds] [-one-time] " + clientOptions, clientTokenCommand, true},
+	"client rekey":        {"client rekey -asset id " + clientOptions, clientRekeyCommand, true},
+	"client grant":        {"client grant -bitmark id -grantee number " + clientOptions, clientGrantCommand, true},
+	"client grants":       {"client grants -bitmark id " + clientOptions, clientGrantsCommand, true},
+	"client revoke":       {"client revoke -bitmark id -grantee number " + clientOptions, clientRevokeCommand, true},
+	"client audit":        {"client audit [-after sequence] [-limit count] [-account number] [-action name] " + clientOptions, clientAuditCommand, true},
+	"client audit-verify": {"client audit-verify " + clientOptions, clientAuditVerifyCommand, true},
+	"client status":       {"client status " + clientOptions, clientStatusCommand, true},
+}
+
+func printCommandUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: bitmark-trade -conf=<config file path> [command]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nclient commands don't require -conf and exit with:\n")
+	for _, s := range []struct {
+		status int
+		reason string
+	}{
+		{exitFailure, "unexpected failure"},
+		{exitUsage, "invalid arguments"},
+		{exitValidation, string(ErrCodeValidation)},
+		{exitNotFound, string(ErrCodeNotFound)},
+		{exitNotCustodial, string(ErrCodeNotCustodial)},
+		{exitUpstreamUnavailable, string(ErrCodeUpstreamUnavailable)},
+		{exitUpstreamRejected, string(ErrCodeUpstreamRejected)},
+		{exitCryptoFailure, string(ErrCodeCryptoFailure)},
+		{exitIntegrityFailure, string(ErrCodeIntegrityFailure)},
+		{exitInternal, string(ErrCodeInternal)},
+		{exitUnreachable, "service unreachable"},
+		{exitRateLimited, string(ErrCodeRateLimited) + ", " + string(ErrCodeQuotaExceeded)},
+	} {
+		fmt.Fprintf(os.Stderr, "  %2d  %s\n", s.status, s.reason)
+	}
+}
+
+func runCommand(cfg *config, args []string) int {
+	if len(args) < 2 {
+		printCommandUsage()
+		return 2
+	}
+
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		printCommandUsage()
+		return 2
+	}
+
+	if !cmd.remote {
+		if cfg.DataDir == "" {
+			fmt.Fprintf(os.Stderr, "%s requires -conf\n", args[0]+" "+args[1])
+			return 2
+		}
+		s, err := openStorage(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open the storage: %s\n", err)
+			return 1
+		}
+		storage = s
+		defer storage.Close()
+
+		// the db commands inspect and migrate the schema themselves
+		if args[0] == "db" {
+			if _, ok := storage.(boltStorage); !ok {
+				fmt.Fprintf(os.Stderr, "%s only applies to the bolt storage\n", args[0]+" "+args[1])
+				return 2
+			}
+			err = createBuckets()
+		} else {
+			err = storage.Setup(false, nil)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to init the storage: %s\n", err)
+			return 1
+		}
+	}
+
+	if err := cmd.run(cfg, args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		if e, ok := err.(*exitError); ok {
+			return e.status
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/stretchr/testify/assert"
+)
+
+// runTestCommand runs the command and returns its exit status
+// along with what it printed
+func runTestCommand(t *testing.T, cfg *config, args ...string) (int, string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	status := runCommand(cfg, args)
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(out)
+}
+
+func TestRunCommandUsage(t *testing.T) {
+	status, _ := runTestCommand(t, &config{}, "accounts")
+	assert.Equal(t, exitUsage, status)
+	status, _ = runTestCommand(t, &config{}, "accounts", "remove")
+	assert.Equal(t, exitUsage, status)
+
+	// the offline commands need the database
+	status, _ = runTestCommand(t, &config{}, "accounts", "list")
+	assert.Equal(t, exitUsage, status)
+}
+
+func TestAccountsCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitmark-trade-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &config{DataDir: dir}
+
+	// the offline commands leave a new database to be migrated first
+	status, out := runTestCommand(t, cfg, "accounts", "list")
+	assert.Equal(t, 1, status)
+	assert.Empty(t, out)
+	status, _ = runTestCommand(t, cfg, "db", "migrate")
+	assert.Equal(t, 0, status)
+
+	acct, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountNo := acct.AccountNumber()
+
+	status, out = runTestCommand(t, cfg, "accounts", "import", "-seed", acct.Seed(), "-register=false")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, accountNo+"\n", out)
+
+	status, _ = runTestCommand(t, cfg, "accounts", "import", "-seed", acct.Seed(), "-register=false")
+	assert.Equal(t, 1, status)
+
+	status, out = runTestCommand(t, cfg, "accounts", "list")
+	assert.Equal(t, 0, status)
+	assert.JSONEq(t, `{"account": "`+accountNo+`"}`, out)
+
+	status, out = runTestCommand(t, cfg, "accounts", "show", accountNo)
+	assert.Equal(t, 0, status)
+	var info map[string]string
+	assert.NoError(t, json.Unmarshal([]byte(out), &info))
+	assert.Equal(t, accountNo, info["account"])
+	assert.Empty(t, info["seed"])
+
+	status, out = runTestCommand(t, cfg, "accounts", "verify")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "1 accounts verified\n", out)
+
+	// a seed stored under the number of another account
+	other, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Accounts().Put(other.AccountNumber(), []byte(acct.Seed())))
+	s.Close()
+
+	status, out = runTestCommand(t, cfg, "accounts", "verify")
+	assert.Equal(t, 1, status)
+	assert.Equal(t, other.AccountNumber()+": seed derives "+accountNo+"\n", out)
+
+	// the import is recorded in the audit log
+	status, out = runTestCommand(t, cfg, "audit", "list", "-action", AuditImportAccount)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, 1, strings.Count(out, `"account":"`+accountNo+`"`))
+
+	status, out = runTestCommand(t, cfg, "db", "stats")
+	assert.Equal(t, 0, status)
+	assert.Contains(t, out, "schema version")
+}
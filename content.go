@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"golang.org/x/crypto/sha3"
+)
+
+// computeFingerprint returns the fingerprint the asset is registered with
+func computeFingerprint(content []byte) string {
+	digest := sha3.Sum512(content)
+	return "01" + hex.EncodeToString(digest[:])
+}
+
+// computeAssetId returns the id of the asset registered with the fingerprint
+func computeAssetId(fingerprint string) string {
+	assetIndex := sha3.Sum512([]byte(fingerprint))
+	return hex.EncodeToString(assetIndex[:])
+}
+
+// assetCacheKey identifies the content of the asset in the cache. The
+// same asset is encrypted under different data keys on each network.
+func assetCacheKey(assetId string) string {
+	return string(bmksdk.GetNetwork()) + "-" + assetId
+}
+
+// sessionDataKey returns the data key shared with the account for the
+// bitmark held by the owner. The key is kept once decrypted from the
+// session data and reused while the account owns the bitmark or holds
+// a grant of its owner. The access to the content is returned only
+// when the session data is fetched.
+func sessionDataKey(ctx context.Context, acct account.Account, bitmarkId, owner, assetId string) (DataKey, *access, error) {
+	accountNo := acct.AccountNumber()
+	entitled, err := holdsAccess(accountNo, bitmarkId, owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entitled {
+		if dataKey, ok := dataKeys.get(bitmarkId, accountNo, owner); ok {
+			return dataKey, nil, nil
+		}
+	}
+
+	access, err := service.getAssetAccess(ctx, acct, bitmarkId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	senderEncrPubkey, err := service.getEncPubkey(ctx, access.Sender)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := dataKeyFromSessionData(acct, access.SessData, senderEncrPubkey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if entitled {
+		dataKeys.put(bitmarkId, accountNo, owner, assetId, dataKey)
+	}
+	return dataKey, access, nil
+}
+
+// holdsAccess reports whether the account owns the bitmark
+// or holds a grant of its owner
+func holdsAccess(accountNo, bitmarkId, owner string) (bool, error) {
+	if accountNo == owner {
+		return true, nil
+	}
+
+	grants, err := listGrants(bitmarkId)
+	if err != nil {
+		return false, internalError("failed to read the grants: %s", err)
+	}
+	for _, g := range grants {
+		if g.Grantee == accountNo && g.Owner == owner {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decryptAsset fetches the encrypted content of the bitmark's asset,
+// decrypts it with the data key shared to the account and checks it
+// against the registered fingerprint of the asset
+func decryptAsset(ctx context.Context, acct account.Account, bitmarkId, owner string, a *asset.Asset) (string, []byte, error) {
+	assetId := a.Id
+	cacheKey := assetCacheKey(assetId)
+
+	dataKey, access, err := sessionDataKey(ctx, acct, bitmarkId, owner, assetId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the cached content is stale if the asset has been re-encrypted meanwhile
+	if fileName, encryptedFileContent, ok := assetCache.get(cacheKey); ok {
+		plaintext, err := openAssetContent(a, dataKey, encryptedFileContent)
+		if err == nil {
+			return fileName, plaintext, nil
+		}
+		assetCache.remove(cacheKey)
+	}
+
+	// the content is fetched along with fresh session data,
+	// as the kept key is stale too once the asset is re-encrypted
+	if access == nil {
+		dataKeys.remove(bitmarkId, acct.AccountNumber())
+		dataKey, access, err = sessionDataKey(ctx, acct, bitmarkId, owner, assetId)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	fileName, encryptedFileContent, err := service.getAssetContent(ctx, access.URL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext, err := openAssetContent(a, dataKey, encryptedFileContent)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := assetCache.put(cacheKey, fileName, encryptedFileContent); err != nil {
+		log.Warnf("failed to cache the content of the asset %s: %s", assetId, err)
+	}
+
+	return fileName, plaintext, nil
+}
+
+// openAssetContent decrypts the content and checks it against
+// the registered fingerprint of the asset
+func openAssetContent(a *asset.Asset, dataKey DataKey, encryptedFileContent []byte) ([]byte, error) {
+	plaintext, err := dataKey.Decrypt(encryptedFileContent, []byte(a.Id))
+	if err != nil {
+		return nil, cryptoError("failed to decrypt the asset: %s", err)
+	}
+	cryptoBytes.Add(float64(len(plaintext)), "decrypt")
+
+	if fingerprint := computeFingerprint(plaintext); fingerprint != a.Fingerprint {
+		return nil, integrityError("content of the asset %s doesn't match its fingerprint", a.Id)
+	}
+
+	return plaintext, nil
+}
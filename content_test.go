@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAssetContentChecksTheFingerprint(t *testing.T) {
+	content := []byte("asset content")
+	fingerprint := computeFingerprint(content)
+	a := &asset.Asset{Id: computeAssetId(fingerprint), Fingerprint: fingerprint}
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := dataKey.Encrypt(content, []byte(a.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := openAssetContent(a, dataKey, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, content, plaintext)
+
+	// content decrypting fine but registered under another fingerprint
+	other := &asset.Asset{Id: a.Id, Fingerprint: computeFingerprint([]byte("other content"))}
+	_, err = openAssetContent(other, dataKey, encrypted)
+	assert.Equal(t, ErrCodeIntegrityFailure, err.(*TradeError).Code)
+
+	wrongKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openAssetContent(a, wrongKey, encrypted)
+	assert.Equal(t, ErrCodeCryptoFailure, err.(*TradeError).Code)
+}
+
+func TestLoadAssetRejectsTamperedContent(t *testing.T) {
+	stub, done := useUpstreamStub(t)
+	defer done()
+
+	owner := stub.newAccount(t)
+	a := stub.addAsset(t, owner, []byte("asset content"))
+	b := stub.addBitmark(a.Id, owner.AccountNumber())
+
+	stub.Lock()
+	stub.assets[a.Id].Fingerprint = computeFingerprint([]byte("registered content"))
+	stub.Unlock()
+
+	_, err := loadAsset(context.Background(), owner.AccountNumber(), b.Id)
+	if assert.Error(t, err) {
+		assert.Equal(t, ErrCodeIntegrityFailure, err.(*TradeError).Code)
+	}
+
+	// the mismatching content isn't served from the cache afterwards
+	_, _, ok := assetCache.get(assetCacheKey(a.Id))
+	assert.False(t, ok)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -12,71 +14,181 @@ import (
 )
 
 const (
-	AlgChaCha20Poly1305 = "chacha20poly1305"
+	AlgChaCha20Poly1305  = "chacha20poly1305"
+	AlgXChaCha20Poly1305 = "xchacha20poly1305"
+	AlgAES256GCM         = "aes-256-gcm"
 )
 
+// dataKeyAlgorithm describes how to build a data key of an algorithm.
+// The algorithms kept for legacy content only decrypt.
+type dataKeyAlgorithm struct {
+	keySize   int
+	fromBytes func(key []byte) DataKey
+	legacy    bool
+}
+
+// dataKeyAlgorithms is the registry of the supported data key algorithms
+var dataKeyAlgorithms = map[string]dataKeyAlgorithm{
+	AlgChaCha20Poly1305: {
+		keySize:   chacha20poly1305.KeySize,
+		fromBytes: func(key []byte) DataKey { return &ChaCha20DataKey{key} },
+		legacy:    true,
+	},
+	AlgXChaCha20Poly1305: {
+		keySize:   chacha20poly1305.KeySize,
+		fromBytes: func(key []byte) DataKey { return &XChaCha20DataKey{key} },
+	},
+	AlgAES256GCM: {
+		keySize:   32,
+		fromBytes: func(key []byte) DataKey { return &AES256GCMDataKey{key} },
+	},
+}
+
+// defaultDataKeyAlgorithm is used to encrypt newly uploaded assets
+var defaultDataKeyAlgorithm = AlgXChaCha20Poly1305
+
+func setDefaultDataKeyAlgorithm(alg string) error {
+	a, ok := dataKeyAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported data key algorithm: %s", alg)
+	}
+	if a.legacy {
+		return fmt.Errorf("%s only decrypts legacy content, use %s", alg, AlgXChaCha20Poly1305)
+	}
+	defaultDataKeyAlgorithm = alg
+	return nil
+}
+
+// DataKey encrypts the content of an asset. The additional data,
+// normally the asset id, is authenticated along with the content.
 type DataKey interface {
-	Encrypt(plaintext []byte) ([]byte, error)
-	Decrypt(ciphertext []byte) ([]byte, error)
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
 	Bytes() []byte
 	Algorithm() string
 }
 
+// ChaCha20DataKey is the key of the content sealed with an all-zero
+// nonce, which the other Bitmark clients expect under its name. New
+// content is encrypted with XChaCha20DataKey instead.
 type ChaCha20DataKey struct {
 	key []byte
 }
 
-func newChaCha20DataKey() (*ChaCha20DataKey, error) {
-	key := make([]byte, chacha20poly1305.KeySize)
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+func (k *ChaCha20DataKey) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	return nil, fmt.Errorf("%s only decrypts legacy content", AlgChaCha20Poly1305)
+}
+
+// Decrypt the legacy ciphertext sealed using zero nonce. The legacy
+// format authenticates no additional data.
+func (k *ChaCha20DataKey) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(k.key)
+	if err != nil {
 		return nil, err
 	}
 
-	return &ChaCha20DataKey{key: key}, nil
+	return openLegacy(aead, ciphertext)
 }
 
-// Encrypt the plaintext using zero nonce
-func (k *ChaCha20DataKey) Encrypt(plaintext []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.New(k.key)
+func (k *ChaCha20DataKey) Bytes() []byte {
+	return k.key
+}
+
+func (k *ChaCha20DataKey) Algorithm() string {
+	return AlgChaCha20Poly1305
+}
+
+// XChaCha20DataKey seals the content in the framed format, whose nonce
+// is picked at random
+type XChaCha20DataKey struct {
+	key []byte
+}
+
+// Encrypt the plaintext with XChaCha20-Poly1305 using a random nonce
+func (k *XChaCha20DataKey) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newXChaCha20Poly1305(k.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealFramed(aead, plaintext, additionalData)
+}
+
+// Decrypt the framed ciphertext
+func (k *XChaCha20DataKey) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newXChaCha20Poly1305(k.key)
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return openFramed(aead, ciphertext, additionalData)
+}
 
-	// Not to reuse plaintext's storage for the encrypted output
-	ciphertext := aead.Seal(nil, nonce, plaintext, nil)
+func (k *XChaCha20DataKey) Bytes() []byte {
+	return k.key
+}
 
-	return ciphertext, nil
+func (k *XChaCha20DataKey) Algorithm() string {
+	return AlgXChaCha20Poly1305
 }
 
-// Decrypt the ciphertext using zero nonce
-func (k *ChaCha20DataKey) Decrypt(ciphertext []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.New(k.key)
+type AES256GCMDataKey struct {
+	key []byte
+}
+
+// Encrypt the plaintext using a random nonce
+func (k *AES256GCMDataKey) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead()
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return sealFramed(aead, plaintext, additionalData)
+}
 
-	plaintext, err := aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+// Decrypt the framed ciphertext
+func (k *AES256GCMDataKey) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead()
 	if err != nil {
 		return nil, err
 	}
 
-	return plaintext, nil
+	return openFramed(aead, ciphertext, additionalData)
 }
 
-func (k *ChaCha20DataKey) Bytes() []byte {
+func (k *AES256GCMDataKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *AES256GCMDataKey) Bytes() []byte {
 	return k.key
 }
 
-func (k *ChaCha20DataKey) Algorithm() string {
-	return AlgChaCha20Poly1305
+func (k *AES256GCMDataKey) Algorithm() string {
+	return AlgAES256GCM
 }
 
+// NewDataKey generates a random data key of the default algorithm
 func NewDataKey() (DataKey, error) {
-	return newChaCha20DataKey()
+	return newDataKey(defaultDataKeyAlgorithm)
+}
+
+func newDataKey(alg string) (DataKey, error) {
+	a, ok := dataKeyAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported data key algorithm: %s", alg)
+	}
+
+	key := make([]byte, a.keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return a.fromBytes(key), nil
 }
 
 type SessionData struct {
@@ -117,7 +229,7 @@ func createSessionData(acct account.Account, key DataKey, recipientEncrPubkey []
 	encrKey := getEncrKey(acct)
 	encrDataKey, err := encrKey.Encrypt(key.Bytes(), recipientEncrPubkey)
 	if err != nil {
-		return nil, fmt.Errorf("data key encryption failed: %v", err)
+		return nil, cryptoError("data key encryption failed: %v", err)
 	}
 	return &SessionData{
 		EncryptedDataKey: encrDataKey,
@@ -129,10 +241,16 @@ func dataKeyFromSessionData(acct account.Account, data *SessionData, senderEncrP
 	encrKey := getEncrKey(acct)
 	key, err := encrKey.Decrypt(data.EncryptedDataKey, senderEncrPubkey)
 	if err != nil {
-		return nil, fmt.Errorf("session data not for the recipient: %v", err)
+		return nil, cryptoError("session data not for the recipient: %v", err)
+	}
+
+	a, ok := dataKeyAlgorithms[data.DataKeyAlgorithm]
+	if !ok {
+		return nil, cryptoError("unsupported data key algorithm: %s", data.DataKeyAlgorithm)
+	}
+	if len(key) != a.keySize {
+		return nil, cryptoError("invalid %s data key size: %d", data.DataKeyAlgorithm, len(key))
 	}
 
-	// switch data.DataKeyAlgorithm to determine which algorithm to generate data key
-	// if more versions are supported in the future
-	return &ChaCha20DataKey{key}, nil
+	return a.fromBytes(key), nil
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// the test vector of draft-irtf-cfrg-xchacha, section 2.2.1
+func TestHChaCha20(t *testing.T) {
+	key := mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	nonce := mustDecodeHex(t, "000000090000004a0000000031415927")
+
+	assert.Equal(t,
+		"82413b4227b27bfed30e42508a877d73a0f9e4d58a74a853c12ec41326d3ecdc",
+		hex.EncodeToString(hchacha20(key, nonce)))
+}
+
+// the test vector of draft-irtf-cfrg-xchacha, appendix A.3.1
+func TestXChaCha20Poly1305Seal(t *testing.T) {
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	aad := mustDecodeHex(t, "50515253c0c1c2c3c4c5c6c7")
+	key := mustDecodeHex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := mustDecodeHex(t, "404142434445464748494a4b4c4d4e4f5051525354555657")
+
+	aead, err := newXChaCha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := aead.Seal(nil, nonce, plaintext, aad)
+	assert.Equal(t,
+		"bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb"+
+			"731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b452"+
+			"2f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff9"+
+			"21f9664c97637da9768812f615c68b13b52e"+
+			"c0875924c1c7987947deafd8780acf49",
+		hex.EncodeToString(sealed))
+
+	opened, err := aead.Open(nil, nonce, sealed, aad)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+}
+
+func TestDataKeyRoundTrip(t *testing.T) {
+	for _, alg := range []string{AlgXChaCha20Poly1305, AlgAES256GCM} {
+		key, err := newDataKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, alg, key.Algorithm())
+
+		plaintext := []byte("asset content")
+		first, err := key.Encrypt(plaintext, []byte("asset-a"))
+		assert.NoError(t, err)
+		second, err := key.Encrypt(plaintext, []byte("asset-a"))
+		assert.NoError(t, err)
+		assert.True(t, hasCiphertextHeader(first), alg)
+		assert.False(t, bytes.Equal(first, second), "%s reused a nonce", alg)
+
+		opened, err := key.Decrypt(first, []byte("asset-a"))
+		assert.NoError(t, err, alg)
+		assert.Equal(t, plaintext, opened, alg)
+
+		_, err = key.Decrypt(first, []byte("asset-b"))
+		assert.Error(t, err, "%s accepted content of another asset", alg)
+	}
+}
+
+func TestLegacyChaCha20DataKey(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	key[0] = 1
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := aead.Seal(nil, make([]byte, aead.NonceSize()), []byte("legacy content"), nil)
+
+	dataKey := &ChaCha20DataKey{key}
+	opened, err := dataKey.Decrypt(legacy, []byte("asset"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("legacy content"), opened)
+
+	// only the zero nonce content is accepted under the legacy name
+	framed, err := (&XChaCha20DataKey{key}).Encrypt([]byte("framed content"), []byte("asset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dataKey.Decrypt(framed, []byte("asset"))
+	assert.Error(t, err)
+
+	_, err = dataKey.Encrypt([]byte("new content"), []byte("asset"))
+	assert.Error(t, err)
+
+	// the new algorithm doesn't fall back to the zero nonce
+	_, err = (&XChaCha20DataKey{key}).Decrypt(legacy, []byte("asset"))
+	assert.Error(t, err)
+}
+
+func TestSetDefaultDataKeyAlgorithm(t *testing.T) {
+	defer func(alg string) { defaultDataKeyAlgorithm = alg }(defaultDataKeyAlgorithm)
+
+	assert.Error(t, setDefaultDataKeyAlgorithm(AlgChaCha20Poly1305))
+	assert.Error(t, setDefaultDataKeyAlgorithm("rot13"))
+	assert.NoError(t, setDefaultDataKeyAlgorithm(AlgAES256GCM))
+	assert.Equal(t, AlgAES256GCM, defaultDataKeyAlgorithm)
+}
+
+func TestSessionDataCarriesTheAlgorithm(t *testing.T) {
+	sender, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderPubkey := getEncrKey(sender).PublicKeyBytes()
+	recipientPubkey := getEncrKey(recipient).PublicKeyBytes()
+
+	for _, alg := range []string{AlgXChaCha20Poly1305, AlgAES256GCM} {
+		key, err := newDataKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := createSessionData(sender, key, recipientPubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, alg, data.DataKeyAlgorithm)
+
+		// the algorithm survives the encoding kept by the upstream
+		var decoded SessionData
+		assert.NoError(t, json.Unmarshal([]byte(data.String()), &decoded))
+
+		received, err := dataKeyFromSessionData(recipient, &decoded, senderPubkey)
+		assert.NoError(t, err, alg)
+		assert.Equal(t, alg, received.Algorithm())
+		assert.Equal(t, key.Bytes(), received.Bytes())
+	}
+
+	// the session data of legacy content still yields its key
+	legacyKey := &ChaCha20DataKey{make([]byte, chacha20poly1305.KeySize)}
+	data, err := createSessionData(sender, legacyKey, recipientPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := dataKeyFromSessionData(recipient, data, senderPubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, AlgChaCha20Poly1305, received.Algorithm())
+
+	unknown := *data
+	unknown.DataKeyAlgorithm = "rot13"
+	_, err = dataKeyFromSessionData(recipient, &unknown, senderPubkey)
+	assert.Equal(t, ErrCodeCryptoFailure, err.(*TradeError).Code)
+
+	// a key of the wrong size for the algorithm named
+	short, err := createSessionData(sender, &AES256GCMDataKey{make([]byte, 16)}, recipientPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dataKeyFromSessionData(recipient, short, senderPubkey)
+	assert.EqualError(t, err, "invalid aes-256-gcm data key size: 16")
+
+	// only the recipient opens the session data
+	_, err = dataKeyFromSessionData(sender, data, senderPubkey)
+	assert.Error(t, err)
+}
@@ -1,72 +1,94 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
 	"github.com/bitmark-inc/bitmark-sdk-go/account"
-	"github.com/bitmark-inc/bitmark-sdk-go/encoding"
 	"github.com/boltdb/bolt"
-	"golang.org/x/crypto/sha3"
 )
 
 func getAccountBucketName() []byte {
-	return []byte(fmt.Sprintf("account-%s", string(bmksdk.GetNetwork())))
+	return accountBucketName(bmksdk.GetNetwork())
 }
 
-func getAccount(accountNo string) (account.Account, error) {
-	var val []byte
+func accountBucketName(network bmksdk.Network) []byte {
+	return []byte(fmt.Sprintf("account-%s", string(network)))
+}
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(getAccountBucketName())
-		val = b.Get([]byte(accountNo))
-		return nil
-	})
+// viewDB runs a read-only transaction and records its duration
+func viewDB(fn func(*bolt.Tx) error) error {
+	defer dbDuration.ObserveSince(time.Now(), "view")
+	return db.View(fn)
+}
+
+// updateDB runs a read-write transaction and records its duration
+func updateDB(fn func(*bolt.Tx) error) error {
+	defer dbDuration.ObserveSince(time.Now(), "update")
+	return db.Update(fn)
+}
+
+func getAccount(accountNo string) (account.Account, error) {
+	val, err := storage.Accounts().Get(accountNo)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get the account from db: %s", err)
+		return nil, internalError("failed to get the account from db: %s", err)
 	}
 
 	if val == nil {
-		return nil, fmt.Errorf("account %s not registered", accountNo)
+		return nil, notCustodialError(accountNo)
 	}
 
-	var seed string
-	switch len(val) {
-	case 32:
-		var b bytes.Buffer
-
-		// write the seed header
-		b.Write([]byte{0x5a, 0xfe, 0x01})
-
-		// write the network
-		switch bmksdk.GetNetwork() {
-		case bmksdk.Livenet:
-			b.Write([]byte{byte(0x00)})
-		case bmksdk.Testnet:
-			b.Write([]byte{byte(0x01)})
-		}
+	acct, err := decodeAccount(val)
+	if err != nil {
+		return nil, internalError("invalid account format for %s: %s", accountNo, err)
+	}
+	return acct, nil
+}
 
-		// write the core 32 bytes
-		b.Write(val)
+// decodeAccount restores the account from its stored seed. The cores
+// stored by early versions which the migration left untouched are
+// still decoded; accounts verify reports them.
+func decodeAccount(val []byte) (account.Account, error) {
+	if len(val) == legacyCoreSize {
+		return account.FromSeed(legacySeed(val))
+	}
+	return account.FromSeed(string(val))
+}
 
-		// write the checksum
-		checksum := sha3.Sum256(b.Bytes())
-		b.Write(checksum[:4])
+func addAccount(acct account.Account) error {
+	return storage.Accounts().Put(acct.AccountNumber(), []byte(acct.Seed()))
+}
 
-		seed = encoding.ToBase58(b.Bytes())
-	case 33:
-		seed = string(val)
-	default:
-		return nil, fmt.Errorf("invalid account format: %s", string(val))
+func dbStatsCommand(cfg *config, args []string) error {
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		return err
 	}
 
-	return account.FromSeed(seed)
-}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "file\t%s\n", db.Path())
+	fmt.Fprintf(w, "size\t%d\n", info.Size())
+	viewDB(func(tx *bolt.Tx) error {
+		fmt.Fprintf(w, "schema version\t%d\n", getSchemaVersion(tx))
+		return nil
+	})
+	fmt.Fprintf(w, "page size\t%d\n", db.Info().PageSize)
+	fmt.Fprintf(w, "free pages\t%d\n\n", db.Stats().FreePageN)
 
-func addAccount(acct account.Account) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(getAccountBucketName())
-		return b.Put([]byte(acct.AccountNumber()), []byte(acct.Seed()))
+	fmt.Fprintln(w, "BUCKET\tKEYS\tDEPTH\tBYTES IN USE")
+	err = viewDB(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			s := b.Stats()
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, s.KeyN, s.Depth, s.BranchInuse+s.LeafInuse)
+			return nil
+		})
 	})
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTokenTTL = 5 * 60
+	maxTokenTTL     = 24 * 60 * 60
+
+	downloadTokenKey = "download-token"
+)
+
+// downloadSecret signs the download tokens
+var downloadSecret []byte
+
+// downloadToken grants the download of a single bitmark's asset
+// until it expires. A one-time token serves the full content only
+// once; the ranged requests resuming the download are served until
+// it expires.
+type downloadToken struct {
+	Network   string `json:"net"`
+	Account   string `json:"a"`
+	BitmarkId string `json:"b"`
+	Expiry    int64  `json:"e"`
+	Nonce     string `json:"n"`
+	OneTime   bool   `json:"o,omitempty"`
+}
+
+type downloadTokenRequest struct {
+	Account   string `json:"account"`
+	BitmarkId string `json:"bitmark_id"`
+	TTL       int    `json:"ttl"`
+	OneTime   bool   `json:"one_time"`
+}
+
+func (r *downloadTokenRequest) validate() error {
+	fields := fieldErrors{}
+
+	if err := validateAccountNumber(r.Account); err != nil {
+		fields.add("account", err.Error())
+	}
+
+	if err := validateHexId(r.BitmarkId, bitmarkIdLength); err != nil {
+		fields.add("bitmark_id", err.Error())
+	}
+
+	if r.TTL < 0 || r.TTL > maxTokenTTL {
+		fields.add("ttl", fmt.Sprintf("must be between 1 and %d seconds", maxTokenTTL))
+	}
+
+	return fields.err()
+}
+
+func initDownloadSecret(secret string) error {
+	if secret != "" {
+		downloadSecret = []byte(secret)
+		return nil
+	}
+
+	// tokens won't survive a restart without a configured secret
+	downloadSecret = make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, downloadSecret)
+	return err
+}
+
+func getDownloadTokenBucketName() []byte {
+	return []byte(fmt.Sprintf("download-token-%s", string(bmksdk.GetNetwork())))
+}
+
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, downloadSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newDownloadToken(accountNo, bitmarkId string, ttl time.Duration, oneTime bool) (string, *downloadToken, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+
+	t := &downloadToken{
+		Network:   string(bmksdk.GetNetwork()),
+		Account:   accountNo,
+		BitmarkId: bitmarkId,
+		Expiry:    time.Now().Add(ttl).Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		OneTime:   oneTime,
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signToken(payload), t, nil
+}
+
+// parseDownloadToken checks the signature and the expiry of the token
+func parseDownloadToken(token string) (*downloadToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, validationError("malformed download token")
+	}
+
+	if !hmac.Equal([]byte(signToken(parts[0])), []byte(parts[1])) {
+		return nil, notFoundError("invalid download token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, validationError("malformed download token")
+	}
+
+	var t downloadToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, validationError("malformed download token")
+	}
+
+	if time.Now().Unix() > t.Expiry {
+		return nil, notFoundError("download token expired")
+	}
+
+	return &t, nil
+}
+
+// redeemDownloadToken marks a one-time token as used. Used nonces are kept
+// until their tokens expire.
+func redeemDownloadToken(t *downloadToken) error {
+	used, err := storage.Nonces().Redeem(t.Nonce, t.Expiry)
+	if err != nil {
+		return err
+	}
+	if used {
+		return notFoundError("download token already used")
+	}
+	return nil
+}
+
+// checkDownloadAccess verifies that the custodial account owns the
+// bitmark or was granted access to it by the current owner
+func checkDownloadAccess(accountNo, bitmarkId string) error {
+	if _, err := getAccount(accountNo); err != nil {
+		return err
+	}
+
+	bmk, err := bitmark.Get(bitmarkId, false)
+	if err != nil {
+		return upstreamError(err, "failed to query the bitmark %s", bitmarkId)
+	}
+	ok, err := holdsAccess(accountNo, bitmarkId, bmk.Owner)
+	if err != nil || ok {
+		return err
+	}
+	return forbiddenError("account %s has no access to the bitmark %s", accountNo, bitmarkId)
+}
+
+// issueDownloadToken issues a token to the authenticated clients only
+func issueDownloadToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req downloadTokenRequest
+		if err := bindJSON(c, &req); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAccount(c, req.Account)
+		auditParam(c, "bitmark_id", req.BitmarkId)
+		auditParam(c, "ttl", strconv.Itoa(req.TTL))
+		auditParam(c, "one_time", strconv.FormatBool(req.OneTime))
+		if err := req.validate(); err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		if err := checkDownloadAccess(req.Account, req.BitmarkId); err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		ttl := req.TTL
+		if ttl == 0 {
+			ttl = defaultTokenTTL
+		}
+
+		token, t, err := newDownloadToken(req.Account, req.BitmarkId, time.Duration(ttl)*time.Second, req.OneTime)
+		if err != nil {
+			abortWithError(c, internalError("failed to issue the download token: %s", err))
+			return
+		}
+
+		auditResult(c, "nonce", t.Nonce)
+		c.JSON(http.StatusOK, gin.H{
+			"token":      token,
+			"url":        "/downloads/" + token,
+			"expires_at": time.Unix(t.Expiry, 0).UTC(),
+		})
+	}
+}
+
+// tokenNetwork verifies the download token and runs the rest of
+// the handlers while the network the token was issued for is active
+func tokenNetwork() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t, err := parseDownloadToken(c.Param("token"))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		n, ok := networks[bmksdk.Network(t.Network)]
+		if !ok {
+			abortWithError(c, notFoundError("invalid download token"))
+			return
+		}
+		c.Set(downloadTokenKey, t)
+
+		runInNetwork(c, n)
+	}
+}
+
+func downloadWithToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet(downloadTokenKey).(*downloadToken)
+		auditAccount(c, t.Account)
+		auditParam(c, "bitmark_id", t.BitmarkId)
+		auditParam(c, "nonce", t.Nonce)
+
+		disposition, err := downloadDisposition(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		content, err := loadAsset(c.Request.Context(), t.Account, t.BitmarkId)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		defer streamResponse(c)()
+		if !t.OneTime {
+			writeAsset(c, disposition, content)
+			return
+		}
+		redeemOnFullResponse(c, t, func() {
+			writeAsset(c, disposition, content)
+		})
+	}
+}
+
+// redeemOnFullResponse uses up the one-time token only when write
+// responds with the full content, so that the partial and the
+// conditional responses don't prevent resuming the download
+func redeemOnFullResponse(c *gin.Context, t *downloadToken, write func()) {
+	header := make(http.Header)
+	for k, v := range c.Writer.Header() {
+		header[k] = v
+	}
+
+	w := &redeemingWriter{ResponseWriter: c.Writer, token: t}
+	c.Writer = w
+	write()
+	c.Writer = w.ResponseWriter
+
+	if w.err != nil {
+		// drop the headers of the content not served
+		for k := range c.Writer.Header() {
+			delete(c.Writer.Header(), k)
+		}
+		for k, v := range header {
+			c.Writer.Header()[k] = v
+		}
+		abortWithError(c, w.err)
+	}
+}
+
+// redeemingWriter redeems the token as the full content is about to be
+// written, and discards the content if it was already used
+type redeemingWriter struct {
+	gin.ResponseWriter
+	token  *downloadToken
+	status int
+	err    error
+}
+
+func (w *redeemingWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	if code == http.StatusOK {
+		w.err = redeemDownloadToken(w.token)
+	}
+	if w.err == nil {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *redeemingWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *redeemingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// redactTokens keeps the download tokens, which are bearer
+// credentials, out of the request log
+type redactTokens struct {
+	out io.Writer
+}
+
+var downloadTokenPath = regexp.MustCompile(`/downloads/[^\s?"]+`)
+
+func (r redactTokens) Write(line []byte) (int, error) {
+	if _, err := r.out.Write(downloadTokenPath.ReplaceAll(line, []byte("/downloads/REDACTED"))); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
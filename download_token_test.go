@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadTokenRoundTrip(t *testing.T) {
+	assert.NoError(t, initDownloadSecret("secret"))
+
+	token, issued, err := newDownloadToken("account", "bitmark", time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseDownloadToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, issued, parsed)
+}
+
+func TestDownloadTokenRejected(t *testing.T) {
+	assert.NoError(t, initDownloadSecret("secret"))
+
+	token, _, err := newDownloadToken("account", "bitmark", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	_, err = parseDownloadToken(parts[0])
+	assert.Equal(t, ErrCodeValidation, err.(*TradeError).Code)
+
+	// another payload under the same signature
+	other, _, _ := newDownloadToken("other", "bitmark", time.Minute, false)
+	_, err = parseDownloadToken(strings.Split(other, ".")[0] + "." + parts[1])
+	assert.Equal(t, ErrCodeNotFound, err.(*TradeError).Code)
+
+	// signed with another secret
+	assert.NoError(t, initDownloadSecret("another secret"))
+	_, err = parseDownloadToken(token)
+	assert.Equal(t, ErrCodeNotFound, err.(*TradeError).Code)
+
+	expired, _, _ := newDownloadToken("account", "bitmark", -time.Minute, false)
+	_, err = parseDownloadToken(expired)
+	assert.Equal(t, ErrCodeNotFound, err.(*TradeError).Code)
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	defer func(verify bool) { verifyClientCertificates = verify }(verifyClientCertificates)
+
+	r := gin.New()
+	r.POST("/downloads", requireClientCertificate(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	// without tls_client_ca there is no certificate to verify
+	verifyClientCertificates = false
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/downloads", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	verifyClientCertificates = true
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/downloads", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `"unauthenticated"`)
+
+	req := httptest.NewRequest("POST", "/downloads", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "backoffice"}}}},
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestAccountDownloadsDisabled(t *testing.T) {
+	defer func(enabled bool) { accountDownloads = enabled }(accountDownloads)
+	accountDownloads = false
+
+	r := gin.New()
+	r.GET("/assets/:accountNo/:bitmarkId", downloadAsset())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/assets/account/bitmark", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), `"forbidden"`)
+}
+
+func TestOneTimeTokenRedeemedOnFullResponse(t *testing.T) {
+	defer openTestBoltStorage(t)()
+	assert.NoError(t, initDownloadSecret("secret"))
+
+	_, token, err := newDownloadToken("account", "bitmark", time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.GET("/downloads/:token", func(c *gin.Context) {
+		redeemOnFullResponse(c, token, func() {
+			c.Header("ETag", `"fingerprint"`)
+			http.ServeContent(c.Writer, c.Request, "file.txt", time.Time{}, strings.NewReader("asset content"))
+		})
+	})
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/downloads/token", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the partial and the conditional responses don't use up the token
+	for i := 0; i < 2; i++ {
+		w := get("Range", "bytes=0-4")
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "asset", w.Body.String())
+	}
+	w := get("If-None-Match", `"fingerprint"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = get("", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "asset content", w.Body.String())
+
+	w = get("", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "already used")
+	assert.Empty(t, w.Header().Get("ETag"))
+
+	// the download can still be resumed
+	w = get("Range", "bytes=6-")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "content", w.Body.String())
+}
+
+func TestRedactTokens(t *testing.T) {
+	var out bytes.Buffer
+	w := redactTokens{&out}
+
+	line := `[GIN] 2026/10/19 | 200 | 1ms | 192.0.2.1 | GET      /downloads/eyJuZXQiOiJ0ZXN0bmV0In0.c2lnbmF0dXJl?disposition=inline` + "\n"
+	n, err := w.Write([]byte(line))
+	assert.NoError(t, err)
+	assert.Equal(t, len(line), n)
+	assert.Equal(t, `[GIN] 2026/10/19 | 200 | 1ms | 192.0.2.1 | GET      /downloads/REDACTED?disposition=inline`+"\n", out.String())
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorCode is the stable, machine-readable class of an error returned to clients
+type ErrorCode string
+
+const (
+	ErrCodeValidation          = ErrorCode("validation_error")
+	ErrCodeNotFound            = ErrorCode("not_found")
+	ErrCodeNotCustodial        = ErrorCode("not_custodial")
+	ErrCodeUnauthenticated     = ErrorCode("unauthenticated")
+	ErrCodeForbidden           = ErrorCode("forbidden")
+	ErrCodeUpstreamUnavailable = ErrorCode("upstream_unavailable")
+	ErrCodeUpstreamRejected    = ErrorCode("upstream_rejected")
+	ErrCodeCryptoFailure       = ErrorCode("crypto_failure")
+	ErrCodeIntegrityFailure    = ErrorCode("integrity_failure")
+	ErrCodeInternal            = ErrorCode("internal_error")
+	ErrCodeRateLimited         = ErrorCode("rate_limited")
+	ErrCodeQuotaExceeded       = ErrorCode("quota_exceeded")
+)
+
+var errorStatus = map[ErrorCode]int{
+	ErrCodeValidation:          http.StatusBadRequest,
+	ErrCodeNotFound:            http.StatusNotFound,
+	ErrCodeNotCustodial:        http.StatusForbidden,
+	ErrCodeUnauthenticated:     http.StatusUnauthorized,
+	ErrCodeForbidden:           http.StatusForbidden,
+	ErrCodeUpstreamUnavailable: http.StatusServiceUnavailable,
+	ErrCodeUpstreamRejected:    http.StatusBadGateway,
+	ErrCodeCryptoFailure:       http.StatusInternalServerError,
+	ErrCodeIntegrityFailure:    http.StatusBadGateway,
+	ErrCodeInternal:            http.StatusInternalServerError,
+	ErrCodeRateLimited:         http.StatusTooManyRequests,
+	ErrCodeQuotaExceeded:       http.StatusTooManyRequests,
+}
+
+// TradeError carries the error class, a human-readable message,
+// the code reported by the Bitmark API for upstream failures and
+// the invalid request fields for validation failures. RetryAfter tells
+// the client when to retry a request which was turned down for now.
+type TradeError struct {
+	Code         ErrorCode
+	Message      string
+	UpstreamCode int
+	Fields       map[string]string
+	RetryAfter   time.Duration
+}
+
+func (e *TradeError) Error() string {
+	return e.Message
+}
+
+func (e *TradeError) StatusCode() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func newError(code ErrorCode, format string, args ...interface{}) *TradeError {
+	return &TradeError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func validationError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeValidation, format, args...)
+}
+
+func notFoundError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeNotFound, format, args...)
+}
+
+func notCustodialError(accountNo string) *TradeError {
+	return newError(ErrCodeNotCustodial, "account %s not registered in this service", accountNo)
+}
+
+func unauthenticatedError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeUnauthenticated, format, args...)
+}
+
+func forbiddenError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeForbidden, format, args...)
+}
+
+func cryptoError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeCryptoFailure, format, args...)
+}
+
+func integrityError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeIntegrityFailure, format, args...)
+}
+
+func internalError(format string, args ...interface{}) *TradeError {
+	return newError(ErrCodeInternal, format, args...)
+}
+
+func rateLimitedError(retryAfter time.Duration) *TradeError {
+	e := newError(ErrCodeRateLimited, "too many requests")
+	e.RetryAfter = retryAfter
+	return e
+}
+
+func quotaExceededError(quota string, limit int64, retryAfter time.Duration) *TradeError {
+	e := newError(ErrCodeQuotaExceeded, "daily %s quota of %d exceeded", quota, limit)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// upstreamError classifies a failure of the Bitmark API, the key server,
+// the asset store or the SDK. The message is prefixed with the context
+// and the upstream code is preserved when available.
+func upstreamError(err error, format string, args ...interface{}) *TradeError {
+	message := fmt.Sprintf("%s: %s", fmt.Sprintf(format, args...), err.Error())
+
+	switch e := err.(type) {
+	case *TradeError:
+		return &TradeError{Code: e.Code, Message: message, UpstreamCode: e.UpstreamCode}
+	case *ServiceError:
+		code := ErrCodeUpstreamRejected
+		switch {
+		case e.StatusCode == http.StatusNotFound:
+			code = ErrCodeNotFound
+		case e.StatusCode >= 500:
+			code = ErrCodeUpstreamUnavailable
+		}
+		return &TradeError{Code: code, Message: message, UpstreamCode: e.Code}
+	case *bmksdk.APIError:
+		return &TradeError{Code: ErrCodeUpstreamRejected, Message: message, UpstreamCode: e.Code}
+	default:
+		return &TradeError{Code: ErrCodeUpstreamUnavailable, Message: message}
+	}
+}
+
+// abortWithError writes the error response in the shape of the API
+// version of the request. Errors without a class are reported as
+// internal errors.
+func abortWithError(c *gin.Context, err error) {
+	e, ok := err.(*TradeError)
+	if !ok {
+		e = internalError("%s", err.Error())
+	}
+
+	if e.StatusCode() >= 500 {
+		log.Errorf("%s %s: [%s] %s", c.Request.Method, c.Request.URL.Path, e.Code, e.Message)
+	}
+
+	body := gin.H{
+		"error": e.Message,
+		"code":  e.Code,
+	}
+	if e.UpstreamCode != 0 {
+		body["upstream_code"] = e.UpstreamCode
+	}
+	if len(e.Fields) > 0 {
+		body["fields"] = e.Fields
+	}
+	if apiVersion(c) >= 2 {
+		body = errorBodyV2(e)
+	}
+
+	if e.RetryAfter > 0 {
+		// round up so that clients don't retry too early
+		seconds := int64((e.RetryAfter + time.Second - 1) / time.Second)
+		c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	c.Error(e)
+	c.AbortWithStatusJSON(e.StatusCode(), body)
+}
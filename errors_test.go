@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTradeErrorStatusCode(t *testing.T) {
+	cases := map[ErrorCode]int{
+		ErrCodeValidation:          http.StatusBadRequest,
+		ErrCodeNotFound:            http.StatusNotFound,
+		ErrCodeNotCustodial:        http.StatusForbidden,
+		ErrCodeUnauthenticated:     http.StatusUnauthorized,
+		ErrCodeForbidden:           http.StatusForbidden,
+		ErrCodeUpstreamUnavailable: http.StatusServiceUnavailable,
+		ErrCodeUpstreamRejected:    http.StatusBadGateway,
+		ErrCodeCryptoFailure:       http.StatusInternalServerError,
+		ErrCodeIntegrityFailure:    http.StatusBadGateway,
+		ErrCodeInternal:            http.StatusInternalServerError,
+		ErrCodeRateLimited:         http.StatusTooManyRequests,
+		ErrCodeQuotaExceeded:       http.StatusTooManyRequests,
+		ErrorCode("unknown"):       http.StatusInternalServerError,
+	}
+	for code, status := range cases {
+		assert.Equal(t, status, newError(code, "failed").StatusCode(), string(code))
+	}
+}
+
+func TestUpstreamErrorClassification(t *testing.T) {
+	cases := []struct {
+		err          error
+		code         ErrorCode
+		upstreamCode int
+	}{
+		{&ServiceError{StatusCode: http.StatusNotFound, Code: 1000, Message: "missing"}, ErrCodeNotFound, 1000},
+		{&ServiceError{StatusCode: http.StatusBadGateway, Message: "down"}, ErrCodeUpstreamUnavailable, 0},
+		{&ServiceError{StatusCode: http.StatusBadRequest, Code: 1001, Message: "invalid"}, ErrCodeUpstreamRejected, 1001},
+		{&bmksdk.APIError{Code: 2000, Message: "invalid signature"}, ErrCodeUpstreamRejected, 2000},
+		{errors.New("connection refused"), ErrCodeUpstreamUnavailable, 0},
+		{forbiddenError("no session data"), ErrCodeForbidden, 0},
+	}
+	for _, tc := range cases {
+		e := upstreamError(tc.err, "failed to query the bitmark %s", "b")
+		assert.Equal(t, tc.code, e.Code, tc.err.Error())
+		assert.Equal(t, tc.upstreamCode, e.UpstreamCode, tc.err.Error())
+		assert.Equal(t, "failed to query the bitmark b: "+tc.err.Error(), e.Message)
+	}
+}
+
+func TestAbortWithError(t *testing.T) {
+	serve := func(err error) *httptest.ResponseRecorder {
+		r := gin.New()
+		r.GET("/", func(c *gin.Context) { abortWithError(c, err) })
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+	body := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var b map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+		return b
+	}
+
+	e := validationError("invalid request")
+	e.Fields = map[string]string{"quantity": "must be positive"}
+	w := serve(e)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]interface{}{
+		"error":  "invalid request",
+		"code":   "validation_error",
+		"fields": map[string]interface{}{"quantity": "must be positive"},
+	}, body(w))
+
+	w = serve(&TradeError{Code: ErrCodeUpstreamRejected, Message: "rejected", UpstreamCode: 1001})
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, float64(1001), body(w)["upstream_code"])
+
+	// the untyped errors are internal ones
+	w = serve(errors.New("disk full"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "internal_error", body(w)["code"])
+
+	// the delay is rounded up to whole seconds
+	w = serve(rateLimitedError(1200 * time.Millisecond))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
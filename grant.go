@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/gin-gonic/gin"
+)
+
+// Grant allows an account other than the owner to decrypt the asset
+// of a bitmark. The session data can't be withdrawn from the API, so a
+// grant is revoked by rotating the data key of the asset.
+type Grant struct {
+	BitmarkId string    `json:"bitmark_id"`
+	AssetId   string    `json:"asset_id"`
+	Owner     string    `json:"owner"`
+	Grantee   string    `json:"grantee"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type grantRequest struct {
+	Grantee string `json:"grantee"`
+}
+
+func (r *grantRequest) validate() error {
+	fields := fieldErrors{}
+
+	if err := validateAccountNumber(r.Grantee); err != nil {
+		fields.add("grantee", err.Error())
+	}
+
+	return fields.err()
+}
+
+func getGrantBucketName() []byte {
+	return []byte(fmt.Sprintf("grant-%s", string(bmksdk.GetNetwork())))
+}
+
+func addGrant(g *Grant) error {
+	return storage.Grants().Put(g)
+}
+
+// removeGrant deletes the grant and returns it, or nil if it doesn't exist
+func removeGrant(bitmarkId, grantee string) (*Grant, error) {
+	return storage.Grants().Remove(bitmarkId, grantee)
+}
+
+func listGrants(bitmarkId string) ([]*Grant, error) {
+	return storage.Grants().List(bitmarkId)
+}
+
+// shareDataKey posts session data that lets the recipient decrypt
+// the asset of the bitmark with the given data key
+func shareDataKey(ctx context.Context, sender account.Account, bitmarkId, recipient string, dataKey DataKey) error {
+	recipientEncrPubkey, err := service.getEncPubkey(ctx, recipient)
+	if err != nil {
+		return err
+	}
+
+	data, err := createSessionData(sender, dataKey, recipientEncrPubkey)
+	if err != nil {
+		return err
+	}
+
+	return service.addSessionData(ctx, sender, bitmarkId, recipient, data)
+}
+
+// custodialBitmark returns the bitmark together with its owner
+// held by this service
+func custodialBitmark(bitmarkId string) (*bitmark.Bitmark, account.Account, error) {
+	bmk, err := bitmark.Get(bitmarkId, false)
+	if err != nil {
+		return nil, nil, upstreamError(err, "failed to query the bitmark %s", bitmarkId)
+	}
+
+	owner, err := getAccount(bmk.Owner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bmk, owner, nil
+}
+
+func validateBitmarkIdParam(c *gin.Context) (string, bool) {
+	bitmarkId := c.Param("bitmarkId")
+	if err := validateHexId(bitmarkId, bitmarkIdLength); err != nil {
+		fields := fieldErrors{}
+		fields.add("bitmarkId", err.Error())
+		abortWithError(c, fields.err())
+		return "", false
+	}
+	return bitmarkId, true
+}
+
+func grantAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bitmarkId, ok := validateBitmarkIdParam(c)
+		if !ok {
+			return
+		}
+		auditParam(c, "bitmark_id", bitmarkId)
+
+		var req grantRequest
+		if err := bindJSON(c, &req); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditParam(c, "grantee", req.Grantee)
+		if err := req.validate(); err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		bmk, owner, err := custodialBitmark(bitmarkId)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAccount(c, bmk.Owner)
+
+		if req.Grantee == bmk.Owner {
+			abortWithError(c, validationError("the grantee already owns the bitmark"))
+			return
+		}
+
+		dataKey, _, err := sessionDataKey(c.Request.Context(), owner, bitmarkId, bmk.Owner, bmk.AssetId)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		if err := shareDataKey(c.Request.Context(), owner, bitmarkId, req.Grantee, dataKey); err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		g := &Grant{
+			BitmarkId: bitmarkId,
+			AssetId:   bmk.AssetId,
+			Owner:     bmk.Owner,
+			Grantee:   req.Grantee,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := addGrant(g); err != nil {
+			abortWithError(c, internalError("failed to save the grant: %s", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, g)
+	}
+}
+
+func listAccessGrants() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bitmarkId, ok := validateBitmarkIdParam(c)
+		if !ok {
+			return
+		}
+
+		grants, err := listGrants(bitmarkId)
+		if err != nil {
+			abortWithError(c, internalError("failed to read the grants: %s", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"grants": grants})
+	}
+}
+
+// revokeAccess removes the grant and rotates the data key of the asset,
+// which shares the new key with the owners and the remaining grantees.
+// The grant is restored if the rotation fails before the content is
+// replaced.
+func revokeAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bitmarkId, ok := validateBitmarkIdParam(c)
+		if !ok {
+			return
+		}
+		grantee := c.Param("grantee")
+		auditParam(c, "bitmark_id", bitmarkId)
+		auditParam(c, "grantee", grantee)
+
+		bmk, _, err := custodialBitmark(bitmarkId)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAccount(c, bmk.Owner)
+
+		g, err := removeGrant(bitmarkId, grantee)
+		if err != nil {
+			abortWithError(c, internalError("failed to remove the grant: %s", err))
+			return
+		}
+		if g == nil {
+			abortWithError(c, notFoundError("no access granted to %s", grantee))
+			return
+		}
+
+		result, err := reencryptAsset(c.Request.Context(), bmk.AssetId)
+		if err != nil {
+			// once the content is replaced, the grantee is left out of
+			// the rekeys retried
+			if result == nil {
+				if e := addGrant(g); e != nil {
+					log.Errorf("failed to restore the grant of %s to %s: %s", bitmarkId, grantee, e)
+				}
+			}
+			abortWithError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"revoked": grantee})
+	}
+}
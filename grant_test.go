@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// grantFixture is a bitmark held by this service, whose asset is
+// uploaded to the stub
+type grantFixture struct {
+	stub    *upstreamStub
+	router  *gin.Engine
+	owner   account.Account
+	bitmark *bitmark.Bitmark
+	content []byte
+}
+
+func newGrantFixture(t *testing.T) (*grantFixture, func()) {
+	stub, done := useUpstreamStub(t)
+
+	f := &grantFixture{
+		stub:    stub,
+		router:  gin.New(),
+		owner:   stub.newAccount(t),
+		content: []byte("asset content"),
+	}
+	a := stub.addAsset(t, f.owner, f.content)
+	f.bitmark = stub.addBitmark(a.Id, f.owner.AccountNumber())
+
+	f.router.POST("/bitmarks/:bitmarkId/grants", grantAccess())
+	f.router.GET("/bitmarks/:bitmarkId/grants", listAccessGrants())
+	f.router.DELETE("/bitmarks/:bitmarkId/grants/:grantee", revokeAccess())
+	return f, done
+}
+
+func (f *grantFixture) do(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+	}
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+func (f *grantFixture) grant(t *testing.T, grantee string) {
+	w := f.do("POST", "/bitmarks/"+f.bitmark.Id+"/grants", `{"grantee": "`+grantee+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func (f *grantFixture) revoke(grantee string) *httptest.ResponseRecorder {
+	return f.do("DELETE", "/bitmarks/"+f.bitmark.Id+"/grants/"+grantee, "")
+}
+
+func (f *grantFixture) grantees(t *testing.T) []string {
+	w := f.do("GET", "/bitmarks/"+f.bitmark.Id+"/grants", "")
+	var result struct {
+		Grants []*Grant `json:"grants"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+
+	grantees := []string{}
+	for _, g := range result.Grants {
+		grantees = append(grantees, g.Grantee)
+	}
+	return grantees
+}
+
+// canDecrypt reports whether the account decrypts the asset with the
+// session data shared with it
+func (f *grantFixture) canDecrypt(acct account.Account) bool {
+	loaded, err := loadAsset(context.Background(), acct.AccountNumber(), f.bitmark.Id)
+	return err == nil && string(loaded.plaintext) == string(f.content)
+}
+
+func TestGrantAndRevokeAccess(t *testing.T) {
+	f, done := newGrantFixture(t)
+	defer done()
+
+	kept, revoked := f.stub.newAccount(t), f.stub.newAccount(t)
+	assert.False(t, f.canDecrypt(kept))
+
+	f.grant(t, kept.AccountNumber())
+	f.grant(t, revoked.AccountNumber())
+	assert.True(t, f.canDecrypt(kept))
+	assert.True(t, f.canDecrypt(revoked))
+
+	// the owner doesn't need a grant
+	w := f.do("POST", "/bitmarks/"+f.bitmark.Id+"/grants", `{"grantee": "`+f.owner.AccountNumber()+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = f.revoke(revoked.AccountNumber())
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{kept.AccountNumber()}, f.grantees(t))
+
+	// the content is re-encrypted under a key the revoked grantee lacks
+	assert.True(t, f.canDecrypt(f.owner))
+	assert.True(t, f.canDecrypt(kept))
+	assert.False(t, f.canDecrypt(revoked))
+
+	w = f.revoke(revoked.AccountNumber())
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRevokeRestoresTheGrantWhenNothingIsReplaced(t *testing.T) {
+	f, done := newGrantFixture(t)
+	defer done()
+
+	grantee := f.stub.newAccount(t)
+	f.grant(t, grantee.AccountNumber())
+
+	// the rekey stops before the upload on a bitmark held elsewhere
+	outsider, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.stub.addBitmark(f.bitmark.AssetId, outsider.AccountNumber())
+
+	w := f.revoke(grantee.AccountNumber())
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	assert.Equal(t, 1, f.stub.uploads)
+	assert.Equal(t, []string{grantee.AccountNumber()}, f.grantees(t))
+}
+
+func TestRevokeKeepsTheGrantRemovedAfterAPartialRekey(t *testing.T) {
+	f, done := newGrantFixture(t)
+	defer done()
+
+	kept, revoked := f.stub.newAccount(t), f.stub.newAccount(t)
+	f.grant(t, kept.AccountNumber())
+	f.grant(t, revoked.AccountNumber())
+
+	// the content is replaced, but the new key can't be shared with kept
+	f.stub.Lock()
+	f.stub.failSessions[kept.AccountNumber()] = true
+	f.stub.Unlock()
+
+	w := f.revoke(revoked.AccountNumber())
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "rekey the asset again")
+	assert.Equal(t, 2, f.stub.uploads)
+	assert.Equal(t, []string{kept.AccountNumber()}, f.grantees(t))
+
+	// the rekey retried as told leaves the revoked grantee out
+	f.stub.Lock()
+	delete(f.stub.failSessions, kept.AccountNumber())
+	f.stub.Unlock()
+
+	_, err := reencryptAsset(context.Background(), f.bitmark.AssetId)
+	assert.NoError(t, err)
+	assert.True(t, f.canDecrypt(f.owner))
+	assert.True(t, f.canDecrypt(kept))
+	assert.False(t, f.canDecrypt(revoked))
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
-	"encoding/hex"
-	"fmt"
+	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bitmark-inc/bitmark-sdk-go/account"
 	"github.com/bitmark-inc/bitmark-sdk-go/asset"
 	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
 	"github.com/bitmark-inc/bitmark-sdk-go/tx"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/sha3"
+	"github.com/gin-gonic/gin/binding"
 )
 
 type issueRequest struct {
@@ -23,6 +25,10 @@ type issueRequest struct {
 	Name       string            `json:"name"`
 	Metadata   map[string]string `json:"metadata"`
 	Quantity   int               `json:"quantity"`
+
+	// set when the content is uploaded instead of read from asset_url
+	fileName    string
+	fileContent []byte
 }
 
 type transferRequest struct {
@@ -30,24 +36,42 @@ type transferRequest struct {
 	NextOnwer string `json:"owner"`
 }
 
+// trackInflight registers the request as an in-flight operation so that
+// the shutdown procedure waits for it to complete before closing the database
+func trackInflight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inflight.Add(1)
+		defer inflight.Done()
+		c.Next()
+	}
+}
+
 func createAccount() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		refund, err := consumeQuota(c, quotaAccounts, 1)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		defer refundOnFailure(c, refund)
+
 		acct, err := account.New()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, internalError("failed to create the account: %s", err))
 			return
 		}
 
-		if err := service.registerEncPubkey(acct); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := service.registerEncPubkey(c.Request.Context(), acct); err != nil {
+			abortWithError(c, err)
 			return
 		}
 
 		if err := addAccount(acct); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, internalError("failed to save the account: %s", err))
 			return
 		}
 
+		auditAccount(c, acct.AccountNumber())
 		c.JSON(http.StatusOK, gin.H{"account": acct.AccountNumber()})
 	}
 }
@@ -55,41 +79,92 @@ func createAccount() gin.HandlerFunc {
 func issueBitmarks() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req issueRequest
-		if err := c.BindJSON(&req); err != nil {
-			c.JSON(400, gin.H{"error": "invalid request body"})
+		var err error
+		if c.ContentType() == binding.MIMEMultipartPOSTForm {
+			err = bindIssueUpload(c, &req)
+		} else {
+			err = bindJSON(c, &req)
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAccount(c, req.Registrant)
+		if req.fileContent != nil {
+			auditParam(c, "file_name", req.fileName)
+		} else {
+			auditParam(c, "asset_url", req.AssetURL)
+		}
+		auditParam(c, "name", req.Name)
+		auditParam(c, "quantity", strconv.Itoa(req.Quantity))
+
+		if err := req.validate(); err != nil {
+			abortWithError(c, err)
 			return
 		}
 
 		issuer, err := getAccount(req.Registrant)
 		if err != nil {
-			c.JSON(400, gin.H{"error": "owner not registered"})
+			abortWithError(c, err)
 			return
 		}
 
-		assaetURL, _ := url.Parse(req.AssetURL)
-		fileName := filepath.Base(assaetURL.Path)
-		fileContent, err := ioutil.ReadFile(assaetURL.Path)
+		refund, err := consumeQuota(c, quotaIssue, int64(req.Quantity), "account:"+req.Registrant)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		defer refundOnFailure(c, refund)
+
+		fileName, fileContent := req.fileName, req.fileContent
+		if fileContent == nil {
+			assaetURL, err := url.Parse(req.AssetURL)
+			if err != nil {
+				abortWithError(c, validationError("invalid asset url"))
+				return
+			}
+			fileName = filepath.Base(assaetURL.Path)
+			fileContent, err = ioutil.ReadFile(assaetURL.Path)
+			if err != nil {
+				abortWithError(c, validationError("unable to read asset file"))
+				return
+			}
+		}
+		assetId := computeAssetId(computeFingerprint(fileContent))
+		auditParam(c, "asset_id", assetId)
+
+		dataKey, err := NewDataKey()
 		if err != nil {
-			c.JSON(400, gin.H{"error": "unable to read asset file"})
+			abortWithError(c, cryptoError("failed to generate the data key: %s", err))
+			return
+		}
+
+		if err := service.uploadAsset(c.Request.Context(), issuer, assetId, fileName, fileContent, dataKey); err != nil {
+			abortWithError(c, err)
 			return
 		}
-		digest := sha3.Sum512(fileContent)
-		fingerprint := "01" + hex.EncodeToString(digest[:])
-		assetIndex := sha3.Sum512([]byte(fingerprint))
-		assetId := hex.EncodeToString(assetIndex[:])
 
-		if err := service.uploadAsset(issuer, assetId, fileName, fileContent); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		file := newAssetFile(fileName, fileContent)
+		if err := putAssetFile(assetId, file); err != nil {
+			abortWithError(c, internalError("failed to save the file of the asset %s: %s", assetId, err))
 			return
 		}
+		auditParam(c, "mime_type", file.MimeType)
 
 		a, _ := asset.Get(assetId)
 		if a == nil || (a != nil && a.Status != "confirmed") {
-			rp, _ := asset.NewRegistrationParams(req.Name, req.Metadata)
-			rp.SetFingerprint(fileContent)
+			rp, err := asset.NewRegistrationParams(req.Name, req.Metadata)
+			if err != nil {
+				abortWithError(c, validationError("%s", err))
+				return
+			}
+			if err := rp.SetFingerprint(fileContent); err != nil {
+				abortWithError(c, validationError("%s", err))
+				return
+			}
 			rp.Sign(issuer)
 			if _, err := asset.Register(rp); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to register the asset: %s", err.Error())})
+				abortWithError(c, upstreamError(err, "failed to register the asset"))
 				return
 			}
 		}
@@ -98,10 +173,15 @@ func issueBitmarks() gin.HandlerFunc {
 		ip.Sign(issuer)
 		bitmarkIds, err := bitmark.Issue(ip)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to issue bitmarks: %s", err.Error())})
+			abortWithError(c, upstreamError(err, "failed to issue bitmarks"))
 			return
 		}
 
+		auditResult(c, "bitmark_ids", strings.Join(bitmarkIds, ","))
+		if apiVersion(c) >= 2 {
+			c.JSON(http.StatusOK, issueResultV2(assetId, bitmarkIds))
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"bitmark_ids": bitmarkIds})
 	}
 }
@@ -109,57 +189,54 @@ func issueBitmarks() gin.HandlerFunc {
 func transferBitmark() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req transferRequest
-		if err := c.BindJSON(&req); err != nil {
-			c.JSON(400, gin.H{"error": "invalid request body"})
+		if err := bindTransferRequest(c, &req); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditParam(c, "txid", req.TxId)
+		auditParam(c, "owner", req.NextOnwer)
+
+		if err := req.validate(); err != nil {
+			abortWithError(c, err)
 			return
 		}
 
 		// query the current owner
 		tx, err := tx.Get(req.TxId, false)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, upstreamError(err, "failed to query the transaction %s", req.TxId))
 			return
 		}
+		auditAccount(c, tx.Owner)
+		auditParam(c, "bitmark_id", tx.BitmarkId)
 		currentOwner, err := getAccount(tx.Owner)
 		if err != nil {
-			c.JSON(400, gin.H{"error": "owner not registered in this service"})
+			abortWithError(c, err)
 			return
 		}
 
 		// handle session data
-		access, err := service.getAssetAccess(currentOwner, tx.BitmarkId)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		senderPublicKey, err := service.getEncPubkey(access.Sender)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		dataKey, err := dataKeyFromSessionData(currentOwner, access.SessData, senderPublicKey)
+		dataKey, _, err := sessionDataKey(c.Request.Context(), currentOwner, tx.BitmarkId, tx.Owner, tx.AssetId)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, err)
 			return
 		}
 
-		recipientEncrPubkey, err := service.getEncPubkey(req.NextOnwer)
+		recipientEncrPubkey, err := service.getEncPubkey(c.Request.Context(), req.NextOnwer)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, err)
 			return
 		}
 
 		data, err := createSessionData(currentOwner, dataKey, recipientEncrPubkey)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, err)
 			return
 		}
 
-		err = service.addSessionData(currentOwner, tx.BitmarkId, req.NextOnwer, data)
+		err = service.addSessionData(c.Request.Context(), currentOwner, tx.BitmarkId, req.NextOnwer, data)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, err)
 			return
 		}
 
@@ -168,58 +245,139 @@ func transferBitmark() gin.HandlerFunc {
 		params.Sign(currentOwner)
 		txId, err := bitmark.Transfer(params)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, upstreamError(err, "failed to transfer the bitmark"))
 			return
 		}
+		dataKeys.removeBitmark(tx.BitmarkId)
 
+		auditResult(c, "txid", txId)
+		if apiVersion(c) >= 2 {
+			c.JSON(http.StatusOK, gin.H{"tx_id": txId, "bitmark_id": tx.BitmarkId})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"txid": txId})
 	}
 }
 
+// accountDownloads serves the assets to anyone who knows the account
+// number of their owner. The assets are downloaded with download
+// tokens only when it is turned off.
+var accountDownloads = true
+
 func downloadAsset() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		accountNo := c.Param("accountNo")
 		bitmarkId := c.Param("bitmarkId")
+		auditAccount(c, accountNo)
+		auditParam(c, "bitmark_id", bitmarkId)
 
-		owner, err := getAccount(accountNo)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if !accountDownloads {
+			abortWithError(c, forbiddenError("downloads by account number are disabled, request a download token"))
 			return
 		}
 
-		access, err := service.getAssetAccess(owner, bitmarkId)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		fields := fieldErrors{}
+		if err := validateAccountNumber(accountNo); err != nil {
+			fields.add("accountNo", err.Error())
 		}
-
-		fileName, encryptedFileContent, err := service.getAssetContent(access.URL)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		if err := validateHexId(bitmarkId, bitmarkIdLength); err != nil {
+			fields.add("bitmarkId", err.Error())
 		}
-
-		senderEncrPubkey, err := service.getEncPubkey(access.Sender)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := fields.err(); err != nil {
+			abortWithError(c, err)
 			return
 		}
 
-		dataKey, err := dataKeyFromSessionData(owner, access.SessData, senderEncrPubkey)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		serveAsset(c, accountNo, bitmarkId)
+	}
+}
 
-		plaintext, err := dataKey.Decrypt(encryptedFileContent)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+// decryptedAsset is the content of a bitmark's asset ready to be served
+type decryptedAsset struct {
+	bitmark   *bitmark.Bitmark
+	file      *assetFile
+	plaintext []byte
+}
+
+// serveAsset responds with the decrypted content of the bitmark's asset
+// on behalf of its custodial owner
+func serveAsset(c *gin.Context, accountNo, bitmarkId string) {
+	disposition, err := downloadDisposition(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-		c.Header("Content-Disposition", "attachment; filename="+fileName)
-		c.Header("Content-Length", strconv.Itoa(len(plaintext)))
-		c.Data(http.StatusOK, http.DetectContentType(plaintext), plaintext)
+	content, err := loadAsset(c.Request.Context(), accountNo, bitmarkId)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
+
+	defer streamResponse(c)()
+	writeAsset(c, disposition, content)
+}
+
+func downloadDisposition(c *gin.Context) (string, error) {
+	disposition := c.DefaultQuery("disposition", dispositionAttachment)
+	if disposition != dispositionAttachment && disposition != dispositionInline {
+		return "", validationError("disposition must be %s or %s", dispositionAttachment, dispositionInline)
+	}
+	return disposition, nil
+}
+
+// loadAsset decrypts the asset of the bitmark with the key shared
+// with the account
+func loadAsset(ctx context.Context, accountNo, bitmarkId string) (*decryptedAsset, error) {
+	owner, err := getAccount(accountNo)
+	if err != nil {
+		return nil, err
+	}
+
+	bmk, err := bitmark.Get(bitmarkId, true)
+	if err != nil {
+		return nil, upstreamError(err, "failed to query the bitmark %s", bitmarkId)
+	}
+	if bmk.Asset == nil {
+		return nil, notFoundError("asset of the bitmark %s not found", bitmarkId)
+	}
+
+	fileName, plaintext, err := decryptAsset(ctx, owner, bitmarkId, bmk.Owner, bmk.Asset)
+	if err != nil {
+		return nil, err
+	}
+
+	// assets issued before the files were recorded are
+	// served under the name given by the asset store
+	file, err := getAssetFile(bmk.Asset.Id)
+	if err != nil {
+		return nil, internalError("failed to read the file of the asset %s: %s", bmk.Asset.Id, err)
+	}
+	if file == nil {
+		file = newAssetFile(fileName, plaintext)
+	}
+
+	return &decryptedAsset{bmk, file, plaintext}, nil
+}
+
+func writeAsset(c *gin.Context, disposition string, content *decryptedAsset) {
+	bmk, file := content.bitmark, content.file
+
+	auditResult(c, "file_name", file.FileName)
+	auditResult(c, "size", strconv.Itoa(len(content.plaintext)))
+	c.Header("X-Content-Fingerprint", bmk.Asset.Fingerprint)
+	c.Header("X-Content-Verified", "true")
+	c.Header("Content-Disposition", contentDisposition(disposition, file.FileName))
+	c.Header("Content-Type", file.MimeType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Accept-Ranges", "bytes")
+	if disposition == dispositionInline {
+		// keep active content shown in a preview from running in our origin
+		c.Header("Content-Security-Policy", "sandbox")
+	}
+
+	// the fingerprint identifies the content, so it makes a strong ETag
+	// for the conditional and ranged requests handled by ServeContent
+	c.Header("ETag", `"`+bmk.Asset.Fingerprint+`"`)
+	http.ServeContent(c.Writer, c.Request, file.FileName, time.Time{}, bytes.NewReader(content.plaintext))
 }
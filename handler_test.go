@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveTestAsset serves the content through writeAsset with the disposition
+func serveTestAsset(disposition string, content []byte, header http.Header) *httptest.ResponseRecorder {
+	fingerprint := computeFingerprint(content)
+	decrypted := &decryptedAsset{
+		bitmark:   &bitmark.Bitmark{Asset: &asset.Asset{Fingerprint: fingerprint}},
+		file:      &assetFile{FileName: "asset.txt", MimeType: "text/plain; charset=utf-8"},
+		plaintext: content,
+	}
+
+	r := gin.New()
+	r.GET("/asset", func(c *gin.Context) { writeAsset(c, disposition, decrypted) })
+
+	req := httptest.NewRequest("GET", "/asset", nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestWriteAssetServesRanges(t *testing.T) {
+	content := []byte("0123456789")
+	etag := `"` + computeFingerprint(content) + `"`
+
+	w := serveTestAsset(dispositionAttachment, content, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+
+	w = serveTestAsset(dispositionAttachment, content, http.Header{"Range": {"bytes=2-5"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "2345", w.Body.String())
+	assert.Equal(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+
+	// resuming from an offset
+	w = serveTestAsset(dispositionAttachment, content, http.Header{"Range": {"bytes=7-"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "789", w.Body.String())
+
+	w = serveTestAsset(dispositionAttachment, content, http.Header{"Range": {"bytes=20-"}})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestWriteAssetChecksTheETag(t *testing.T) {
+	content := []byte("0123456789")
+	etag := `"` + computeFingerprint(content) + `"`
+
+	w := serveTestAsset(dispositionAttachment, content, http.Header{"If-Range": {etag}, "Range": {"bytes=0-3"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "0123", w.Body.String())
+
+	// the whole content once it changed since the part was fetched
+	w = serveTestAsset(dispositionAttachment, content, http.Header{"If-Range": {`"stale"`}, "Range": {"bytes=0-3"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	w = serveTestAsset(dispositionAttachment, content, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	probeTimeout  = 2 * time.Second
+	probeCacheTTL = 10 * time.Second
+)
+
+type dependencyStatus struct {
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Latency string    `json:"latency"`
+	Checked time.Time `json:"checked_at"`
+}
+
+type dependency struct {
+	name string
+	url  string
+}
+
+// readinessProbe checks the reachability of the upstream dependencies
+// and caches the result so that frequent probes don't hit the upstreams
+type readinessProbe struct {
+	sync.Mutex
+	client       *http.Client
+	dependencies []dependency
+	checkedAt    time.Time
+	results      map[string]dependencyStatus
+}
+
+func newReadinessProbe(dependencies ...dependency) *readinessProbe {
+	return &readinessProbe{
+		client:       &http.Client{Timeout: probeTimeout},
+		dependencies: dependencies,
+	}
+}
+
+func (p *readinessProbe) check() map[string]dependencyStatus {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.results != nil && time.Since(p.checkedAt) < probeCacheTTL {
+		return p.results
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	results := make(map[string]dependencyStatus)
+	for _, d := range p.dependencies {
+		wg.Add(1)
+		go func(d dependency) {
+			defer wg.Done()
+			status := p.probe(d.url)
+			mu.Lock()
+			results[d.name] = status
+			mu.Unlock()
+		}(d)
+	}
+	wg.Wait()
+
+	p.results = results
+	p.checkedAt = time.Now()
+	return results
+}
+
+// probe considers a dependency reachable as long as it answers
+// without a server error
+func (p *readinessProbe) probe(url string) dependencyStatus {
+	start := time.Now()
+	status := dependencyStatus{Status: "ok", Checked: start}
+
+	resp, err := p.client.Get(url)
+	status.Latency = time.Since(start).String()
+	if err != nil {
+		status.Status = "unavailable"
+		status.Error = err.Error()
+		return status
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		status.Status = "unavailable"
+		status.Error = fmt.Sprintf("unexpected status code: %d", resp.StatusCode)
+	}
+	return status
+}
+
+func checkDB() error {
+	return storage.Check()
+}
+
+func healthz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := checkDB(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func readyz(p *readinessProbe) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		results := make(map[string]dependencyStatus)
+		for name, r := range p.check() {
+			results[name] = r
+		}
+
+		start := time.Now()
+		dbStatus := dependencyStatus{Status: "ok", Checked: start}
+		if err := checkDB(); err != nil {
+			dbStatus.Status = "unavailable"
+			dbStatus.Error = err.Error()
+		}
+		dbStatus.Latency = time.Since(start).String()
+		results["db"] = dbStatus
+
+		code := http.StatusOK
+		status := "ok"
+		for _, r := range results {
+			if r.Status != "ok" {
+				code = http.StatusServiceUnavailable
+				status = "unavailable"
+			}
+		}
+
+		c.JSON(code, gin.H{"status": status, "dependencies": results})
+	}
+}
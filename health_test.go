@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// upstreamStatus serves the status code it holds and counts the probes
+type upstreamStatus struct {
+	code   int32
+	probes int32
+}
+
+func (u *upstreamStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&u.probes, 1)
+	w.WriteHeader(int(atomic.LoadInt32(&u.code)))
+}
+
+type readiness struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+func getReadiness(t *testing.T, p *readinessProbe) (int, readiness) {
+	r := gin.New()
+	r.GET("/readyz", readyz(p))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body readiness
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w.Code, body
+}
+
+func TestReadinessReportsUnavailableUpstreams(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	api := &upstreamStatus{code: http.StatusOK}
+	apiServer := httptest.NewServer(api)
+	defer apiServer.Close()
+
+	// a client error still proves the upstream reachable
+	store := &upstreamStatus{code: http.StatusNotFound}
+	storeServer := httptest.NewServer(store)
+	defer storeServer.Close()
+
+	p := newReadinessProbe(dependency{"bitmark_api", apiServer.URL}, dependency{"asset_store", storeServer.URL})
+	code, body := getReadiness(t, p)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body.Status)
+	assert.Equal(t, "ok", body.Dependencies["asset_store"].Status)
+
+	p = newReadinessProbe(dependency{"bitmark_api", apiServer.URL}, dependency{"asset_store", storeServer.URL})
+	atomic.StoreInt32(&store.code, http.StatusBadGateway)
+	code, body = getReadiness(t, p)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", body.Status)
+	assert.Equal(t, "ok", body.Dependencies["bitmark_api"].Status)
+	assert.Equal(t, "unavailable", body.Dependencies["asset_store"].Status)
+	assert.Equal(t, "unexpected status code: 502", body.Dependencies["asset_store"].Error)
+
+	// an unreachable upstream
+	storeServer.Close()
+	p = newReadinessProbe(dependency{"asset_store", storeServer.URL})
+	code, body = getReadiness(t, p)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.NotEmpty(t, body.Dependencies["asset_store"].Error)
+}
+
+func TestReadinessCachesTheProbes(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	api := &upstreamStatus{code: http.StatusOK}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	p := newReadinessProbe(dependency{"bitmark_api", server.URL})
+	getReadiness(t, p)
+	atomic.StoreInt32(&api.code, http.StatusInternalServerError)
+	code, _ := getReadiness(t, p)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&api.probes))
+}
+
+func TestReadinessChecksTheDatabase(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	assert.NoError(t, updateDB(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(getAccountBucketName())
+	}))
+
+	code, body := getReadiness(t, newReadinessProbe())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", body.Dependencies["db"].Status)
+
+	r := gin.New()
+	r.GET("/healthz", healthz())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
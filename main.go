@@ -1,29 +1,65 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
-	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
 	"github.com/bitmark-inc/logger"
-	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
 	"github.com/hashicorp/hcl"
 )
 
+const defaultShutdownTimeout = 30
+
 var (
 	service *Service
-	db      *bolt.DB
 	log     *logger.L
+
+	// inflight tracks the issue and transfer operations being processed
+	inflight sync.WaitGroup
 )
 
 type config struct {
-	Chain    string `hcl:"chain"`
-	Port     int    `hcl:"port"`
-	DataDir  string `hcl:"datadir"`
-	APIToken string `hcl:"api_token"`
+	Chain            string            `hcl:"chain"`
+	Chains           []string          `hcl:"chains"`
+	APITokens        map[string]string `hcl:"api_tokens"`
+	Port             int               `hcl:"port"`
+	DataDir          string            `hcl:"datadir"`
+	APIToken         string            `hcl:"api_token"`
+	AssetStore       string            `hcl:"asset_store"`
+	DataKeyAlg       string            `hcl:"data_key_algorithm"`
+	CacheSize        int64             `hcl:"cache_size"`
+	ShutdownTimeout  int               `hcl:"shutdown_timeout"`
+	DownloadSecret   string            `hcl:"download_secret"`
+	AccountDownloads *bool             `hcl:"account_downloads"`
+	Storage          string            `hcl:"storage"`
+	DatabaseURL      string            `hcl:"database_url"`
+
+	RateLimit         float64            `hcl:"rate_limit"`
+	RateBurst         int                `hcl:"rate_burst"`
+	RouteRateLimits   map[string]float64 `hcl:"route_rate_limits"`
+	DailyIssueQuota   int64              `hcl:"daily_issue_quota"`
+	DailyAccountQuota int64              `hcl:"daily_account_quota"`
+
+	APIRateLimit   float64 `hcl:"api_rate_limit"`
+	APIRateBurst   int     `hcl:"api_rate_burst"`
+	APIConcurrency int     `hcl:"api_concurrency"`
+
+	TLSCert          string            `hcl:"tls_cert"`
+	TLSKey           string            `hcl:"tls_key"`
+	TLSClientCA      string            `hcl:"tls_client_ca"`
+	TLSClientAuth    string            `hcl:"tls_client_auth"`
+	ClientIdentities map[string]string `hcl:"client_identities"`
+	TrustedProxies   []string          `hcl:"trusted_proxies"`
 }
 
 func readConfig(confpath string) *config {
@@ -38,63 +74,132 @@ func readConfig(confpath string) *config {
 		panic(fmt.Sprintf("unable to parse the configuration: %v", err))
 	}
 
+	if cfg.DataKeyAlg != "" {
+		if err := setDefaultDataKeyAlgorithm(cfg.DataKeyAlg); err != nil {
+			panic(fmt.Sprintf("invalid configuration: %v", err))
+		}
+	}
+
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = defaultCacheSize
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+
 	return &cfg
 }
 
-func openDB(dbpath string) *bolt.DB {
-	db, err := bolt.Open(dbpath, 0660, nil)
-	if err != nil {
-		panic(fmt.Sprintf("unable to init the databse: %v", err))
+// initNetwork sets up the SDK and the service of every configured chain
+// and activates the default one, which is the chain option or else the
+// first of the chains
+func initNetwork(cfg *config) {
+	chains := cfg.Chains
+	if cfg.Chain != "" {
+		chains = append([]string{cfg.Chain}, chains...)
+	}
+	if len(chains) == 0 {
+		panic("invalid configuration: no chain configured")
 	}
 
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(getAccountBucketName())
+	for _, chain := range chains {
+		apiToken, ok := cfg.APITokens[chain]
+		if !ok {
+			apiToken = cfg.APIToken
+		}
+
+		t := newThrottle(chain, cfg.APIRateLimit, cfg.APIRateBurst, cfg.APIConcurrency)
+		n, err := newNetwork(chain, apiToken, newThrottledClient(t))
 		if err != nil {
-			panic(fmt.Sprintf("unable to init the databse: %v", err))
+			panic(fmt.Sprintf("invalid configuration: %v", err))
+		}
+		if _, ok := networks[n.name]; ok {
+			continue
 		}
 
-		return nil
-	})
+		networks[n.name] = n
+		if defaultNetwork == nil {
+			defaultNetwork = n
+		}
+	}
+
+	defaultNetwork.activate()
+}
 
-	return db
+// apiGroups mounts the versions of the API of the network under the
+// prefix, and the unversioned routes as deprecated aliases of /v1
+func apiGroups(r *gin.Engine, prefix string, n *network) {
+	apiRoutes(r.Group(prefix, deprecated(prefix), limitClient(), useNetwork(n)))
+	apiRoutes(r.Group(prefix+"/v1", limitClient(), useNetwork(n)))
+	apiRoutesV2(r.Group(prefix+"/v2", useAPIVersion(2), limitClient(), useNetwork(n)))
+}
+
+// apiRoutes registers the endpoints of the first version of the API
+func apiRoutes(r gin.IRoutes) {
+	r.POST("/account", limitRoute("account"), auditAction(AuditCreateAccount), createAccount())
+	r.POST("/issue", limitRoute("issue"), trackInflight(), auditAction(AuditIssue), issueBitmarks())
+	r.POST("/transfer", limitRoute("transfer"), trackInflight(), auditAction(AuditTransfer), transferBitmark())
+	r.GET("/assets/:accountNo/:bitmarkId", limitRoute("download"), auditAction(AuditDownload), downloadAsset())
+	r.POST("/downloads", limitRoute("download_token"), auditAction(AuditDownloadToken), requireClientCertificate(), issueDownloadToken())
+	r.POST("/assets/:assetId/rekey", limitRoute("rekey"), trackInflight(), auditAction(AuditRekey), rekeyAsset())
+	r.POST("/bitmarks/:bitmarkId/grants", limitRoute("grant"), trackInflight(), auditAction(AuditGrant), grantAccess())
+	r.GET("/bitmarks/:bitmarkId/grants", limitRoute("grants"), listAccessGrants())
+	r.DELETE("/bitmarks/:bitmarkId/grants/:grantee", limitRoute("revoke"), trackInflight(), auditAction(AuditRevoke), revokeAccess())
+	r.GET("/audit", limitRoute("audit"), listAudit())
+	r.GET("/audit/verify", limitRoute("audit_verify"), verifyAudit())
+}
+
+// newRouter serves the API of every network, the token downloads and
+// the endpoints of the service itself
+func newRouter(dependencies ...dependency) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.LoggerWithWriter(redactTokens{gin.DefaultWriter}), gin.Recovery())
+	// the clients are identified by clientAddress, which only
+	// trusts X-Forwarded-For from the trusted proxies
+	r.ForwardedByClientIP = false
+	r.Use(instrumentRequests(r))
+	r.GET("/metrics", exportMetrics())
+	r.GET("/openapi.json", serveOpenAPISpec())
+	r.GET("/healthz", healthz())
+	r.GET("/readyz", readyz(newReadinessProbe(dependencies...)))
+
+	// the routes without a network prefix serve the default network
+	apiGroups(r, "", defaultNetwork)
+	for _, n := range networks {
+		apiGroups(r, "/"+string(n.name), n)
+	}
+	r.GET("/downloads/:token", limitClient(), limitRoute("download"), tokenNetwork(), auditAction(AuditDownload), downloadWithToken())
+
+	return r
 }
 
 func main() {
-	var confpath string
+	var confpath, chain string
 	flag.StringVar(&confpath, "conf", "", "Specify configuration file")
+	flag.StringVar(&chain, "chain", "", "Override the default chain of the configuration")
+	flag.Usage = printCommandUsage
 	flag.Parse()
 
-	cfg := readConfig(confpath)
-
-	var sdkcfg bmksdk.Config
-	switch cfg.Chain {
-	case "test":
-		sdkcfg = bmksdk.Config{
-			HTTPClient: http.DefaultClient,
-			Network:    bmksdk.Testnet,
-			APIToken:   cfg.APIToken,
-		}
-		service = &Service{
-			http.DefaultClient,
-			"https://api.test.bitmark.com",
-			"https://key.test.bitmarkaccountassets.com",
-		}
-	case "live":
-		sdkcfg = bmksdk.Config{
-			HTTPClient: http.DefaultClient,
-			Network:    bmksdk.Livenet,
-			APIToken:   cfg.APIToken,
-		}
-		service = &Service{
-			http.DefaultClient,
-			"https://api.bitmark.com",
-			"https://key.bitmarkaccountassets.com",
+	// client commands may run without the configuration of the service
+	cfg := &config{}
+	if confpath != "" || flag.NArg() == 0 {
+		cfg = readConfig(confpath)
+		if chain != "" {
+			cfg.Chain = chain
 		}
+		initNetwork(cfg)
 	}
 
-	bmksdk.Init(&sdkcfg)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(cfg, flag.Args()))
+	}
 
-	db = openDB(fmt.Sprintf("%s/bitmark-trade.db", cfg.DataDir))
+	s, err := openStorage(cfg)
+	if err != nil {
+		panic(fmt.Sprintf("unable to open the storage: %v", err))
+	}
+	storage = s
 
 	if err := logger.Initialise(logger.Configuration{
 		Directory: cfg.DataDir,
@@ -108,10 +213,151 @@ func main() {
 
 	log = logger.New("")
 
-	r := gin.Default()
-	r.POST("/account", createAccount())
-	r.POST("/issue", issueBitmarks())
-	r.POST("/transfer", transferBitmark())
-	r.GET("/assets/:accountNo/:bitmarkId", downloadAsset())
-	r.Run(fmt.Sprintf(":%d", cfg.Port))
+	for _, n := range networks {
+		err := withNetwork(n, func() error {
+			return storage.Setup(true, log.Infof)
+		})
+		if err != nil {
+			panic(fmt.Sprintf("unable to init the storage of %s: %s", n.name, err))
+		}
+	}
+
+	cache, err := newContentCache(filepath.Join(cfg.DataDir, "cache"), cfg.CacheSize*1024*1024)
+	if err != nil {
+		panic(fmt.Sprintf("unable to init the asset cache: %s", err))
+	}
+	assetCache = cache
+
+	if cfg.DownloadSecret == "" {
+		// each replica would sign the tokens with a secret of its own
+		if cfg.Storage == storagePostgres {
+			panic("invalid configuration: download_secret is required with the postgres storage")
+		}
+		log.Warn("no download_secret configured, download tokens are invalidated on restart")
+	}
+	if err := initDownloadSecret(cfg.DownloadSecret); err != nil {
+		panic(fmt.Sprintf("unable to init the download secret: %s", err))
+	}
+
+	if cfg.AccountDownloads != nil {
+		accountDownloads = *cfg.AccountDownloads
+	}
+
+	trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("invalid configuration: %s", err))
+	}
+
+	initRateLimits(cfg)
+
+	var dependencies []dependency
+	for _, n := range networks {
+		prefix := ""
+		if len(networks) > 1 {
+			prefix = string(n.name) + "_"
+		}
+		dependencies = append(dependencies,
+			dependency{prefix + "api", n.service.apiEndpoint},
+			dependency{prefix + "key_server", n.service.keyEndpoint})
+	}
+	if cfg.AssetStore != "" {
+		dependencies = append(dependencies, dependency{"asset_store", cfg.AssetStore})
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: newRouter(dependencies...),
+	}
+
+	var certs *certReloader
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		certs, err = newCertReloader(cfg)
+		if err != nil {
+			panic(fmt.Sprintf("unable to init TLS: %s", err))
+		}
+		srv.TLSConfig = certs.tlsConfig()
+		clientIdentities = cfg.ClientIdentities
+		verifyClientCertificates = cfg.TLSClientCA != ""
+	} else if cfg.TLSClientCA != "" {
+		panic("invalid configuration: tls_client_ca requires tls_cert and tls_key")
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if certs != nil {
+			// the certificate comes from the TLS configuration
+			serverErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- srv.ListenAndServe()
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if certs == nil {
+					continue
+				}
+				if err := certs.reload(); err != nil {
+					log.Errorf("unable to reload the certificates: %s", err)
+				} else {
+					log.Info("certificates reloaded")
+				}
+				continue
+			}
+			log.Infof("received signal: %s, shutting down", sig)
+			break wait
+		case err := <-serverErr:
+			log.Criticalf("server stopped unexpectedly: %s", err)
+			break wait
+		}
+	}
+
+	shutdown(srv, time.Duration(cfg.ShutdownTimeout)*time.Second)
+}
+
+// shutdown stops accepting new requests, waits for the in-flight operations
+// until the timeout is reached, then releases the database and the logger
+func shutdown(srv *http.Server, timeout time.Duration) {
+	if drain(srv, timeout) {
+		log.Info("all in-flight operations finished")
+	} else {
+		log.Warn("timed out waiting for in-flight operations")
+	}
+
+	if err := storage.Close(); err != nil {
+		log.Errorf("unable to close the storage: %s", err)
+	}
+
+	log.Info("service stopped")
+	logger.Finalise()
+}
+
+// drain stops accepting new requests and reports whether the in-flight
+// operations finished before the timeout
+func drain(srv *http.Server, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warnf("unable to stop the server gracefully: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
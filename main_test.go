@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitmark-inc/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain serves the testnet, with the log written to a temporary
+// directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "bitmark-trade")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := logger.Initialise(logger.Configuration{
+		Directory: dir,
+		File:      "trade.log",
+		Size:      1048576,
+		Count:     10,
+		Levels:    map[string]string{"DEFAULT": "critical"},
+	}); err != nil {
+		panic(err)
+	}
+	log = logger.New("")
+
+	n, err := newNetwork("test", "", http.DefaultClient)
+	if err != nil {
+		panic(err)
+	}
+	networks[n.name] = n
+	defaultNetwork = n
+	n.activate()
+
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	code := m.Run()
+	logger.Finalise()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// blockingServer serves an in-flight operation which runs until released
+func blockingServer(t *testing.T) (srv *http.Server, url string, started, release chan struct{}) {
+	started, release = make(chan struct{}), make(chan struct{})
+
+	r := gin.New()
+	r.POST("/issue", trackInflight(), func(c *gin.Context) {
+		close(started)
+		<-release
+		c.String(http.StatusOK, "issued")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = &http.Server{Handler: r}
+	go srv.Serve(ln)
+	return srv, "http://" + ln.Addr().String(), started, release
+}
+
+func TestDrainWaitsForInflightOperations(t *testing.T) {
+	srv, url, started, release := blockingServer(t)
+
+	responses := make(chan int)
+	go func() {
+		resp, err := http.Post(url+"/issue", "", nil)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+
+	drained := make(chan bool)
+	go func() { drained <- drain(srv, 5*time.Second) }()
+
+	select {
+	case <-drained:
+		t.Fatal("drained with an operation in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// no request is accepted meanwhile
+	_, err := http.Post(url+"/issue", "", nil)
+	assert.Error(t, err)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-responses)
+	assert.True(t, <-drained)
+}
+
+func TestDrainTimesOut(t *testing.T) {
+	srv, url, started, release := blockingServer(t)
+
+	// the operation finishes before the other tests track theirs
+	defer func() {
+		close(release)
+		inflight.Wait()
+	}()
+
+	go func() {
+		if resp, err := http.Post(url+"/issue", "", nil); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	start := time.Now()
+	assert.False(t, drain(srv, 50*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+}
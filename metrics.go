@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metrics are exposed in the Prometheus text exposition format
+var (
+	defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+	httpRequests = newCounterVec(
+		"trade_http_requests_total",
+		"Number of HTTP requests handled.",
+		"route", "method", "status")
+	httpDuration = newHistogramVec(
+		"trade_http_request_duration_seconds",
+		"Latency of HTTP requests.",
+		defaultBuckets,
+		"route", "method")
+	upstreamRequests = newCounterVec(
+		"trade_upstream_requests_total",
+		"Number of upstream calls by service method and result code.",
+		"method", "code")
+	upstreamDuration = newHistogramVec(
+		"trade_upstream_request_duration_seconds",
+		"Latency of upstream calls by service method.",
+		defaultBuckets,
+		"method")
+	upstreamWait = newHistogramVec(
+		"trade_upstream_wait_seconds",
+		"Time upstream calls spent queued by the outbound limiter.",
+		defaultBuckets,
+		"network")
+	upstreamThrottled = newCounterVec(
+		"trade_upstream_throttled_total",
+		"Number of upstream calls turned down with 429.",
+		"network")
+	cryptoBytes = newCounterVec(
+		"trade_crypto_bytes_total",
+		"Number of asset bytes encrypted or decrypted.",
+		"operation")
+	assetCacheRequests = newCounterVec(
+		"trade_asset_cache_requests_total",
+		"Number of asset cache lookups by result.",
+		"result")
+	assetCacheEvictions = newCounterVec(
+		"trade_asset_cache_evictions_total",
+		"Number of assets evicted from the cache.")
+	dbDuration = newHistogramVec(
+		"trade_db_transaction_duration_seconds",
+		"Duration of storage transactions.",
+		[]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		"type")
+)
+
+type metric interface {
+	write(w *bytes.Buffer)
+}
+
+// label values escape the backslash, the double quote and the line
+// feed, and help texts the backslash and the line feed
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+type labelValues struct {
+	names  []string
+	values []string
+}
+
+func (l labelValues) String() string {
+	if len(l.names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(l.names))
+	for i, name := range l.names {
+		pairs[i] = name + `="` + labelEscaper.Replace(l.values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+}
+
+func (c *counterVec) Add(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += v
+	c.keys[key] = labels
+}
+
+func (c *counterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *counterVec) write(w *bytes.Buffer) {
+	c.Lock()
+	defer c.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.keys) {
+		lv := labelValues{c.labels, c.keys[key]}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, lv, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) Observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *histogramVec) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *histogramVec) write(w *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		bucketLabels := append(append([]string{}, h.labels...), "le")
+		for i, upper := range h.buckets {
+			lv := labelValues{bucketLabels, append(append([]string{}, s.labels...), formatFloat(upper))}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, lv, s.counts[i])
+		}
+		lv := labelValues{bucketLabels, append(append([]string{}, s.labels...), "+Inf")}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, lv, s.count)
+
+		lv = labelValues{h.labels, s.labels}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, lv, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, lv, s.count)
+	}
+}
+
+// gaugeFunc reports a value computed at scrape time
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() (float64, error)
+}
+
+func (g *gaugeFunc) write(w *bytes.Buffer) {
+	v, err := g.fn()
+	if err != nil {
+		log.Warnf("unable to collect %s: %s", g.name, err)
+		return
+	}
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+}
+
+var custodialAccounts = &gaugeFunc{
+	name: "trade_custodial_accounts",
+	help: "Number of accounts held by the service.",
+	fn: func() (float64, error) {
+		n, err := storage.Accounts().Count()
+		return float64(n), err
+	},
+}
+
+var assetCacheBytes = &gaugeFunc{
+	name: "trade_asset_cache_bytes",
+	help: "Total size of the cached asset content.",
+	fn: func() (float64, error) {
+		return float64(assetCache.Size()), nil
+	},
+}
+
+var registry = []metric{
+	httpRequests,
+	httpDuration,
+	upstreamRequests,
+	upstreamDuration,
+	upstreamWait,
+	upstreamThrottled,
+	cryptoBytes,
+	assetCacheRequests,
+	assetCacheEvictions,
+	assetCacheBytes,
+	dbDuration,
+	custodialAccounts,
+}
+
+func writeHeader(w *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// observeUpstream records the latency and the result of an upstream call.
+// Failures carrying a service error are labelled with its code.
+func observeUpstream(method string, start time.Time, err error) {
+	upstreamDuration.ObserveSince(start, method)
+
+	code := "ok"
+	if err != nil {
+		code = "error"
+		if se, ok := err.(*ServiceError); ok {
+			code = strconv.Itoa(se.Code)
+		}
+	}
+	upstreamRequests.Inc(method, code)
+}
+
+// instrumentRequests counts and times every request by its route template.
+// The template is resolved from the registered handler so that path
+// parameters such as account numbers don't end up in label values. The
+// handlers served under several prefixes are told apart by the path.
+func instrumentRequests(r *gin.Engine) gin.HandlerFunc {
+	var (
+		once   sync.Once
+		routes map[string][]string
+	)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		once.Do(func() {
+			routes = make(map[string][]string)
+			for _, route := range r.Routes() {
+				key := route.Method + " " + route.Handler
+				routes[key] = append(routes[key], route.Path)
+			}
+		})
+
+		route := "unmatched"
+		templates := routes[c.Request.Method+" "+c.HandlerName()]
+		if len(templates) > 0 {
+			route = templates[0]
+		}
+		for _, template := range templates {
+			if matchRoute(template, c.Request.URL.Path) {
+				route = template
+				break
+			}
+		}
+
+		httpRequests.Inc(route, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+		httpDuration.ObserveSince(start, route, c.Request.Method)
+	}
+}
+
+// matchRoute reports whether the path matches the route template
+func matchRoute(template, path string) bool {
+	want := strings.Split(template, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+
+	for i := range want {
+		if !strings.HasPrefix(want[i], ":") && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func exportMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var buf bytes.Buffer
+		for _, m := range registry {
+			m.write(&buf)
+		}
+
+		c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVecWrite(t *testing.T) {
+	c := newCounterVec("test_total", "Number of tests.", "route", "code")
+	c.Inc("/b", "200")
+	c.Add(2.5, "/a", "500")
+	c.Inc("/b", "200")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	assert.Equal(t, `# HELP test_total Number of tests.
+# TYPE test_total counter
+test_total{route="/a",code="500"} 2.5
+test_total{route="/b",code="200"} 2
+`, buf.String())
+}
+
+func TestCounterVecWithoutLabels(t *testing.T) {
+	c := newCounterVec("test_total", "Number of tests.")
+	c.Inc()
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	assert.Equal(t, `# HELP test_total Number of tests.
+# TYPE test_total counter
+test_total 1
+`, buf.String())
+}
+
+func TestHistogramVecCumulativeBuckets(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Duration of tests.", []float64{.1, 1, 10}, "method")
+	for _, v := range []float64{.05, .1, .5, 3, 20} {
+		h.Observe(v, "GET")
+	}
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	assert.Equal(t, `# HELP test_seconds Duration of tests.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="GET",le="0.1"} 2
+test_seconds_bucket{method="GET",le="1"} 3
+test_seconds_bucket{method="GET",le="10"} 4
+test_seconds_bucket{method="GET",le="+Inf"} 5
+test_seconds_sum{method="GET"} 23.65
+test_seconds_count{method="GET"} 5
+`, buf.String())
+}
+
+func TestHistogramVecSeriesAreSeparate(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Duration of tests.", []float64{1}, "method")
+	h.Observe(2, "POST")
+	h.Observe(.5, "GET")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	assert.Equal(t, `# HELP test_seconds Duration of tests.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="GET",le="1"} 1
+test_seconds_bucket{method="GET",le="+Inf"} 1
+test_seconds_sum{method="GET"} 0.5
+test_seconds_count{method="GET"} 1
+test_seconds_bucket{method="POST",le="1"} 0
+test_seconds_bucket{method="POST",le="+Inf"} 1
+test_seconds_sum{method="POST"} 2
+test_seconds_count{method="POST"} 1
+`, buf.String())
+}
+
+func TestLabelAndHelpEscaping(t *testing.T) {
+	c := newCounterVec("test_total", "Paths under C:\\trade\nand more.", "path")
+	c.Inc("a\"b\\c\nd\té")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	assert.Equal(t, `# HELP test_total Paths under C:\\trade\nand more.
+# TYPE test_total counter
+test_total{path="a\"b\\c\nd	é"} 1
+`, buf.String())
+}
+
+func TestGaugeFuncWrite(t *testing.T) {
+	g := &gaugeFunc{
+		name: "test_items",
+		help: "Number of items.",
+		fn:   func() (float64, error) { return 42, nil },
+	}
+
+	var buf bytes.Buffer
+	g.write(&buf)
+
+	assert.Equal(t, `# HELP test_items Number of items.
+# TYPE test_items gauge
+test_items 42
+`, buf.String())
+}
+
+func TestMatchRoute(t *testing.T) {
+	assert.True(t, matchRoute("/v1/assets/:accountNo/:bitmarkId", "/v1/assets/abc/def"))
+	assert.True(t, matchRoute("/testnet/v1/account", "/testnet/v1/account"))
+	assert.False(t, matchRoute("/v1/assets/:accountNo/:bitmarkId", "/testnet/v1/assets/abc/def"))
+	assert.False(t, matchRoute("/v1/account", "/v2/account"))
+}
+
+func TestInstrumentRequestsUsesRouteTemplates(t *testing.T) {
+	r := gin.New()
+	r.Use(instrumentRequests(r))
+	handler := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.GET("/v1/items/:id", handler)
+	r.GET("/testnet/v1/items/:id", handler)
+
+	for _, path := range []string{"/v1/items/1", "/testnet/v1/items/2", "/testnet/v1/items/3"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	httpRequests.Lock()
+	defer httpRequests.Unlock()
+	assert.Equal(t, float64(1), httpRequests.values["/v1/items/:id\xffGET\xff204"])
+	assert.Equal(t, float64(2), httpRequests.values["/testnet/v1/items/:id\xffGET\xff204"])
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/encoding"
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/sha3"
+)
+
+var schemaVersionKey = []byte("schema_version")
+
+// errDryRun rolls back the transaction of a migration run in dry-run mode
+var errDryRun = errors.New("dry run")
+
+// migration upgrades the data of the network to the next schema version.
+// It runs within a single transaction together with the version update
+// and describes each change through report.
+type migration struct {
+	version     uint64
+	description string
+	migrate     func(tx *bolt.Tx, report func(format string, args ...interface{})) error
+}
+
+// migrations are applied in order, each of them exactly once
+var migrations = []migration{
+	{1, "store legacy 32-byte account cores as seeds", migrateLegacySeeds},
+}
+
+func getMetaBucketName() []byte {
+	return []byte(fmt.Sprintf("meta-%s", string(bmksdk.GetNetwork())))
+}
+
+func getSchemaVersion(tx *bolt.Tx) uint64 {
+	v := tx.Bucket(getMetaBucketName()).Get(schemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putSchemaVersion(tx *bolt.Tx, version uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, version)
+	return tx.Bucket(getMetaBucketName()).Put(schemaVersionKey, v)
+}
+
+// migrateDB applies the pending migrations and returns the schema version
+// reached. In dry-run mode the changes are reported and rolled back.
+func migrateDB(dryRun bool, report func(format string, args ...interface{})) (uint64, error) {
+	var current uint64
+	if err := viewDB(func(tx *bolt.Tx) error {
+		current = getSchemaVersion(tx)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	pending := make([]migration, 0, len(migrations))
+	for _, m := range migrations {
+		if m.version > current {
+			pending = append(pending, m)
+		}
+	}
+
+	// later migrations may depend on the earlier ones, so all
+	// of them run in the transaction which is rolled back
+	if dryRun {
+		err := updateDB(func(tx *bolt.Tx) error {
+			for _, m := range pending {
+				if err := applyMigration(tx, m, report); err != nil {
+					return err
+				}
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return current, err
+		}
+		return current, nil
+	}
+
+	for _, m := range pending {
+		if err := updateDB(func(tx *bolt.Tx) error {
+			return applyMigration(tx, m, report)
+		}); err != nil {
+			return current, err
+		}
+		current = m.version
+	}
+
+	return current, nil
+}
+
+// latestSchemaVersion is the version reached once all migrations are applied
+func latestSchemaVersion() uint64 {
+	return migrations[len(migrations)-1].version
+}
+
+// checkSchemaVersion ensures the migrations have been applied
+func checkSchemaVersion() error {
+	var current uint64
+	if err := viewDB(func(tx *bolt.Tx) error {
+		current = getSchemaVersion(tx)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if current < latestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is behind %d, run db migrate first", current, latestSchemaVersion())
+	}
+	return nil
+}
+
+func applyMigration(tx *bolt.Tx, m migration, report func(format string, args ...interface{})) error {
+	report("migrating to schema version %d: %s", m.version, m.description)
+	if err := m.migrate(tx, report); err != nil {
+		return fmt.Errorf("migration to schema version %d failed: %s", m.version, err)
+	}
+	return putSchemaVersion(tx, m.version)
+}
+
+// legacyCoreSize is the size of the account cores stored by early versions
+const legacyCoreSize = 32
+
+// migrateLegacySeeds rewrites the accounts stored as their bare core by
+// early versions. The core is kept as is if the seed doesn't derive the
+// account number it is stored under, for accounts verify to report it.
+func migrateLegacySeeds(tx *bolt.Tx, report func(format string, args ...interface{})) error {
+	b := tx.Bucket(getAccountBucketName())
+
+	var legacy [][2]string
+	err := b.ForEach(func(k, v []byte) error {
+		if len(v) != legacyCoreSize {
+			return nil
+		}
+
+		seed := legacySeed(v)
+		acct, err := account.FromSeed(seed)
+		if err != nil || acct.AccountNumber() != string(k) {
+			report("  %s: core doesn't derive the account, left untouched, see accounts verify", k)
+			return nil
+		}
+
+		legacy = append(legacy, [2]string{string(k), seed})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, l := range legacy {
+		report("  %s: stored as seed", l[0])
+		if err := b.Put([]byte(l[0]), []byte(l[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacySeed encodes the 32-byte core as a version 1 seed of the network
+func legacySeed(core []byte) string {
+	var b bytes.Buffer
+
+	// write the seed header
+	b.Write([]byte{0x5a, 0xfe, 0x01})
+
+	// write the network
+	switch bmksdk.GetNetwork() {
+	case bmksdk.Livenet:
+		b.Write([]byte{byte(0x00)})
+	case bmksdk.Testnet:
+		b.Write([]byte{byte(0x01)})
+	}
+
+	// write the core 32 bytes
+	b.Write(core)
+
+	// write the checksum
+	checksum := sha3.Sum256(b.Bytes())
+	b.Write(checksum[:4])
+
+	return encoding.ToBase58(b.Bytes())
+}
+
+func dbMigrateCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the pending changes without applying them")
+	fs.Parse(args)
+
+	report := func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	}
+
+	version, err := migrateDB(*dryRun, report)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("dry run, schema version remains %d\n", version)
+	} else {
+		fmt.Printf("schema version %d\n", version)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestBoltStorage sets up the bolt storage in a temporary directory
+// as the storage of the service
+func openTestBoltStorage(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "bitmark-trade-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openBoltStorage(filepath.Join(dir, "bitmark-trade.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := createBuckets(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage = s
+	return func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrateLegacySeeds(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	core := make([]byte, legacyCoreSize)
+	core[0] = 1
+	acct, err := account.FromSeed(legacySeed(core))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stray := make([]byte, legacyCoreSize)
+	stray[0] = 2
+	strayAcct, err := account.FromSeed(legacySeed(stray))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, updateDB(func(tx *bolt.Tx) error {
+		b := tx.Bucket(getAccountBucketName())
+		if err := b.Put([]byte(acct.AccountNumber()), core); err != nil {
+			return err
+		}
+		return b.Put([]byte("stray"), stray)
+	}))
+
+	version, err := migrateDB(false, func(string, ...interface{}) {})
+	assert.NoError(t, err)
+	assert.Equal(t, latestSchemaVersion(), version)
+	assert.NoError(t, checkSchemaVersion())
+
+	seed, err := storage.Accounts().Get(acct.AccountNumber())
+	assert.NoError(t, err)
+	assert.Equal(t, acct.Seed(), string(seed))
+
+	// the core which doesn't derive its account number is kept decodable
+	seed, err = storage.Accounts().Get("stray")
+	assert.NoError(t, err)
+	assert.Equal(t, stray, seed)
+	decoded, err := decodeAccount(seed)
+	assert.NoError(t, err)
+	assert.Equal(t, strayAcct.AccountNumber(), decoded.AccountNumber())
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	version, err := migrateDB(true, func(string, ...interface{}) {})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), version)
+	assert.Error(t, checkSchemaVersion())
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/gin-gonic/gin"
+)
+
+// network holds the SDK configuration and the service of a chain
+type network struct {
+	name    bmksdk.Network
+	sdk     bmksdk.Config
+	service *Service
+}
+
+var (
+	// networks served by this instance, by name
+	networks = make(map[bmksdk.Network]*network)
+
+	// defaultNetwork serves the routes without a network prefix
+	defaultNetwork *network
+
+	gate = newNetworkGate()
+)
+
+// newNetwork sets up the chain to send its requests with the client,
+// which paces them for the API token
+func newNetwork(chain, apiToken string, client *http.Client) (*network, error) {
+	switch chain {
+	case "test":
+		return &network{
+			name: bmksdk.Testnet,
+			sdk: bmksdk.Config{
+				HTTPClient: client,
+				Network:    bmksdk.Testnet,
+				APIToken:   apiToken,
+			},
+			service: &Service{
+				client,
+				"https://api.test.bitmark.com",
+				"https://key.test.bitmarkaccountassets.com",
+			},
+		}, nil
+	case "live":
+		return &network{
+			name: bmksdk.Livenet,
+			sdk: bmksdk.Config{
+				HTTPClient: client,
+				Network:    bmksdk.Livenet,
+				APIToken:   apiToken,
+			},
+			service: &Service{
+				client,
+				"https://api.bitmark.com",
+				"https://key.bitmarkaccountassets.com",
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown chain: %q", chain)
+	}
+}
+
+// activate points the SDK and the service at the network
+func (n *network) activate() {
+	bmksdk.Init(&n.sdk)
+	service = n.service
+}
+
+// networkGate lets the requests of a single network at a time run.
+// The SDK keeps its configuration in package globals, so the gate
+// switches to another network only once the requests of the active
+// one have completed or are waiting for an upstream. Networks waiting
+// for the switch go first, so that a busy network doesn't starve the
+// other.
+type networkGate struct {
+	sync.Mutex
+	cond    *sync.Cond
+	active  *network
+	running int
+	waiting map[*network]int
+}
+
+// gateHold is the place of a caller in the gate. Only its holder may
+// suspend it, so that the callers which don't hold the gate can't let
+// another network in under a running request.
+type gateHold struct {
+	network *network
+	held    bool
+}
+
+type gateHoldKey struct{}
+
+// withGateHold returns a context that carries the hold
+func withGateHold(ctx context.Context, h *gateHold) context.Context {
+	return context.WithValue(ctx, gateHoldKey{}, h)
+}
+
+// gateHoldOf returns the hold carried by the context, if any
+func gateHoldOf(ctx context.Context) *gateHold {
+	h, _ := ctx.Value(gateHoldKey{}).(*gateHold)
+	return h
+}
+
+func newNetworkGate() *networkGate {
+	g := &networkGate{waiting: make(map[*network]int)}
+	g.cond = sync.NewCond(g)
+	return g
+}
+
+func (g *networkGate) admits(n *network) bool {
+	if g.active != n {
+		return g.running == 0
+	}
+
+	for w, count := range g.waiting {
+		if w != n && count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *networkGate) enter(n *network) *gateHold {
+	g.Lock()
+	defer g.Unlock()
+
+	h := &gateHold{network: n}
+	g.admit(h)
+	return h
+}
+
+// admit waits for the network of the hold to be active. The gate must
+// be locked.
+func (g *networkGate) admit(h *gateHold) {
+	n := h.network
+
+	g.waiting[n]++
+	for !g.admits(n) {
+		g.cond.Wait()
+	}
+	g.waiting[n]--
+
+	if g.active != n {
+		n.activate()
+		g.active = n
+
+		// let the other requests of the network in
+		g.cond.Broadcast()
+	}
+	g.running++
+	h.held = true
+}
+
+func (g *networkGate) leave(h *gateHold) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.release(h)
+}
+
+// release gives up the place of the hold. The gate must be locked.
+func (g *networkGate) release(h *gateHold) {
+	if !h.held {
+		return
+	}
+	h.held = false
+
+	g.running--
+	if g.running == 0 {
+		g.cond.Broadcast()
+	}
+}
+
+// suspend lets the other networks in while the holder of the gate
+// waits for an upstream. The function returned waits for the network
+// to be active again. Nothing is suspended without a hold, such as for
+// the commands, which don't hold the gate.
+func (g *networkGate) suspend(h *gateHold) (resume func()) {
+	g.Lock()
+	defer g.Unlock()
+
+	if h == nil || !h.held {
+		return func() {}
+	}
+
+	g.release(h)
+	return func() {
+		g.Lock()
+		defer g.Unlock()
+		g.admit(h)
+	}
+}
+
+// withNetwork runs fn while the network is active
+func withNetwork(n *network, fn func() error) error {
+	h := gate.enter(n)
+	defer gate.leave(h)
+	return fn()
+}
+
+// useNetwork runs the rest of the handlers while the network is active
+func useNetwork(n *network) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		runInNetwork(c, n)
+	}
+}
+
+// runInNetwork runs the rest of the handlers while the network is
+// active. The request context carries the hold of the gate. The
+// response is held back until the network is left, so that a slow
+// client doesn't hold back the requests of the other networks, unless
+// the handler streams it.
+func runInNetwork(c *gin.Context, n *network) {
+	w := &bufferedWriter{ResponseWriter: c.Writer}
+	c.Set(bufferedWriterKey, w)
+
+	func() {
+		c.Writer = w
+		defer func() { c.Writer = w.ResponseWriter }()
+
+		h := gate.enter(n)
+		defer gate.leave(h)
+
+		c.Request = c.Request.WithContext(withGateHold(c.Request.Context(), h))
+		w.hold = h
+		c.Next()
+	}()
+
+	w.flush()
+}
+
+// streamResponse lets the handler write a large body, once it is done
+// with the network, without keeping it in memory. The gate is left
+// while the body is written and taken back by the function returned,
+// before the handlers after the handler use the network again.
+func streamResponse(c *gin.Context) (done func()) {
+	v, ok := c.Get(bufferedWriterKey)
+	if !ok {
+		return func() {}
+	}
+	w := v.(*bufferedWriter)
+	w.streaming = true
+
+	return func() {
+		w.streaming = false
+		if w.resume != nil {
+			w.resume()
+			w.resume = nil
+		}
+	}
+}
+
+const bufferedWriterKey = "buffered-writer"
+
+// bufferedWriter keeps the body until flush is called. The status is
+// recorded by the writer of gin, which sends it with the first write.
+// A streaming body is written through once the gate is suspended.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	written bool
+	body    bytes.Buffer
+
+	hold      *gateHold
+	streaming bool
+	resume    func()
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	w.written = true
+	if w.streaming {
+		w.streamThrough()
+		return w.ResponseWriter.Write(data)
+	}
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// streamThrough suspends the gate and writes the body kept, once
+func (w *bufferedWriter) streamThrough() {
+	if w.resume != nil {
+		return
+	}
+	w.resume = gate.suspend(w.hold)
+	w.flush()
+}
+
+func (w *bufferedWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	if w.resume != nil {
+		return w.ResponseWriter.Size()
+	}
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.written
+}
+
+// Flush is deferred to flush, or to the end of the streaming
+func (w *bufferedWriter) Flush() {
+	if w.resume != nil {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// flush writes the status and the body kept
+func (w *bufferedWriter) flush() {
+	if w.written {
+		w.ResponseWriter.WriteHeaderNow()
+		w.ResponseWriter.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func testNetworks(t *testing.T) (*network, *network) {
+	test, err := newNetwork("test", "", http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := newNetwork("live", "", http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test, live
+}
+
+func TestNetworkGateSuspend(t *testing.T) {
+	test, live := testNetworks(t)
+	defer defaultNetwork.activate()
+
+	h := gate.enter(test)
+	resume := gate.suspend(h)
+
+	entered := make(chan struct{})
+	go func() {
+		withNetwork(live, func() error {
+			close(entered)
+			return nil
+		})
+	}()
+
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("the other network was held back while the gate was suspended")
+	}
+
+	resume()
+	assert.Equal(t, test, gate.active)
+	gate.leave(h)
+}
+
+func TestNetworkGateSuspendWithoutHold(t *testing.T) {
+	test, _ := testNetworks(t)
+	defer defaultNetwork.activate()
+
+	h := gate.enter(test)
+
+	// the callers which don't hold the gate, such as the commands or
+	// the SDK, can't suspend the request running
+	gate.suspend(nil)()
+	gate.suspend(gateHoldOf(context.Background()))()
+
+	gate.Lock()
+	assert.Equal(t, 1, gate.running)
+	gate.Unlock()
+
+	// nor can a hold suspend twice
+	resume := gate.suspend(h)
+	gate.suspend(h)()
+	gate.Lock()
+	assert.Equal(t, 0, gate.running)
+	gate.Unlock()
+
+	resume()
+	gate.leave(h)
+	gate.leave(h)
+
+	gate.Lock()
+	defer gate.Unlock()
+	assert.Equal(t, 0, gate.running)
+}
+
+// gateRecorder records whether the gate was held when the body was written
+type gateRecorder struct {
+	*httptest.ResponseRecorder
+	running int
+}
+
+func (r *gateRecorder) Write(data []byte) (int, error) {
+	gate.Lock()
+	r.running = gate.running
+	gate.Unlock()
+	return r.ResponseRecorder.Write(data)
+}
+
+func TestUseNetworkWritesTheResponseOutsideTheGate(t *testing.T) {
+	test, _ := testNetworks(t)
+	defer defaultNetwork.activate()
+
+	r := gin.New()
+	r.Use(useNetwork(test))
+	r.GET("/items", func(c *gin.Context) {
+		c.Header("X-Item", "1")
+		c.JSON(http.StatusCreated, gin.H{"id": 1})
+	})
+
+	w := &gateRecorder{ResponseRecorder: httptest.NewRecorder(), running: -1}
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/items", nil))
+
+	assert.Equal(t, 0, w.running)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Item"))
+	assert.JSONEq(t, `{"id": 1}`, w.Body.String())
+}
+
+func TestUseNetworkCarriesTheHold(t *testing.T) {
+	test, _ := testNetworks(t)
+	defer defaultNetwork.activate()
+
+	r := gin.New()
+	r.Use(useNetwork(test))
+	r.GET("/items", func(c *gin.Context) {
+		h := gateHoldOf(c.Request.Context())
+		if assert.NotNil(t, h) {
+			assert.True(t, h.held)
+			assert.Equal(t, test, h.network)
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/items", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestStreamResponseWritesOutsideTheGate(t *testing.T) {
+	test, _ := testNetworks(t)
+	defer defaultNetwork.activate()
+
+	var after int
+	r := gin.New()
+	r.Use(useNetwork(test))
+	r.Use(func(c *gin.Context) {
+		c.Next()
+
+		// the handlers after the streaming one have the network again
+		gate.Lock()
+		after = gate.running
+		gate.Unlock()
+	})
+	r.GET("/items", func(c *gin.Context) {
+		defer streamResponse(c)()
+		c.Header("X-Item", "1")
+		c.String(http.StatusOK, "streamed")
+	})
+
+	w := &gateRecorder{ResponseRecorder: httptest.NewRecorder(), running: -1}
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/items", nil))
+
+	assert.Equal(t, 0, w.running)
+	assert.Equal(t, 1, after)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Item"))
+	assert.Equal(t, "streamed", w.Body.String())
+}
+
+func TestUseNetworkLeavesTheGateOnPanic(t *testing.T) {
+	test, _ := testNetworks(t)
+	defer defaultNetwork.activate()
+
+	r := gin.New()
+	r.Use(gin.Recovery(), useNetwork(test))
+	r.GET("/items", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		panic("failure")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/items", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "partial")
+
+	gate.Lock()
+	defer gate.Unlock()
+	assert.Equal(t, 0, gate.running)
+}
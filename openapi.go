@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec describes the endpoints of the service. Keep it in step
+// with the routes of apiRoutes and apiRoutesV2 and with the request and
+// response types of the handlers.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "Bitmark Trade",
+    "description": "Custodial issuance, transfer and download of Bitmark assets. The routes of /v1 are also served without the version prefix; those are deprecated and answer with Deprecation and Link headers pointing to /v1.",
+    "version": "1.0.0"
+  },
+  "servers": [
+    {"url": "/", "description": "the default network"},
+    {"url": "/testnet", "description": "testnet, when served"},
+    {"url": "/livenet", "description": "livenet, when served"}
+  ],
+  "paths": {
+    "/v1/account": {
+      "post": {
+        "summary": "Create a custodial account",
+        "operationId": "createAccount",
+        "responses": {
+          "200": {"description": "the account created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Account"}}}},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/issue": {
+      "post": {
+        "summary": "Register an asset and issue bitmarks of it",
+        "description": "The content is either uploaded or read from asset_url on the host of the service.",
+        "operationId": "issueBitmarks",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/IssueRequest"}},
+            "multipart/form-data": {"schema": {"$ref": "#/components/schemas/IssueUpload"}}
+          }
+        },
+        "responses": {
+          "200": {"description": "the bitmarks issued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueResult"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/transfer": {
+      "post": {
+        "summary": "Countersign a transfer offered to a custodial account",
+        "operationId": "transferBitmark",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransferRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "the transfer submitted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransferResult"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/assets/{accountNo}/{bitmarkId}": {
+      "get": {
+        "summary": "Download the decrypted asset of a bitmark",
+        "description": "Served unless account_downloads is turned off, in which case download tokens are used instead.",
+        "operationId": "downloadAsset",
+        "parameters": [
+          {"$ref": "#/components/parameters/AccountNo"},
+          {"$ref": "#/components/parameters/BitmarkId"},
+          {"$ref": "#/components/parameters/Disposition"},
+          {"$ref": "#/components/parameters/Range"},
+          {"$ref": "#/components/parameters/IfRange"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Content"},
+          "206": {"$ref": "#/components/responses/PartialContent"},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "416": {"description": "the range can't be satisfied"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/downloads": {
+      "post": {
+        "summary": "Issue a signed download link",
+        "description": "The account must own the bitmark or have been granted access to it. When tls_client_ca is set, the client must present a verified certificate.",
+        "operationId": "issueDownloadToken",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DownloadTokenRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "the download token", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DownloadToken"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "401": {"$ref": "#/components/responses/Unauthenticated"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/downloads/{token}": {
+      "servers": [{"url": "/"}],
+      "get": {
+        "summary": "Download the decrypted asset with a download token",
+        "description": "The token carries the network it was issued for and needs no other credential.",
+        "operationId": "downloadWithToken",
+        "parameters": [
+          {"name": "token", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/Disposition"},
+          {"$ref": "#/components/parameters/Range"},
+          {"$ref": "#/components/parameters/IfRange"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Content"},
+          "206": {"$ref": "#/components/responses/PartialContent"},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "416": {"description": "the range can't be satisfied"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/assets/{assetId}/rekey": {
+      "post": {
+        "summary": "Re-encrypt an asset under a new data key",
+        "description": "Every bitmark of the asset must be held by the service.",
+        "operationId": "rekeyAsset",
+        "parameters": [{"$ref": "#/components/parameters/AssetId"}],
+        "responses": {
+          "200": {"description": "the bitmarks given the new data key", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RekeyResult"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/bitmarks/{bitmarkId}/grants": {
+      "parameters": [{"$ref": "#/components/parameters/BitmarkId"}],
+      "post": {
+        "summary": "Grant another account read access to the asset of a bitmark",
+        "operationId": "grantAccess",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GrantRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "the grant", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Grant"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "get": {
+        "summary": "List the read access grants of a bitmark",
+        "operationId": "listAccessGrants",
+        "responses": {
+          "200": {"description": "the grants", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GrantList"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/bitmarks/{bitmarkId}/grants/{grantee}": {
+      "delete": {
+        "summary": "Revoke a read access grant by rotating the data key of the asset",
+        "operationId": "revokeAccess",
+        "parameters": [
+          {"$ref": "#/components/parameters/BitmarkId"},
+          {"name": "grantee", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/AccountNumber"}}
+        ],
+        "responses": {
+          "200": {"description": "the grant revoked", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Revocation"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "403": {"$ref": "#/components/responses/NotCustodial"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/audit": {
+      "get": {
+        "summary": "List the audit records",
+        "operationId": "listAudit",
+        "parameters": [
+          {"name": "after", "in": "query", "description": "sequence number to list the records after", "schema": {"type": "integer", "minimum": 0, "default": 0}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}},
+          {"name": "account", "in": "query", "schema": {"$ref": "#/components/schemas/AccountNumber"}},
+          {"name": "action", "in": "query", "schema": {"$ref": "#/components/schemas/AuditAction"}}
+        ],
+        "responses": {
+          "200": {"description": "the records", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuditList"}}}},
+          "400": {"$ref": "#/components/responses/ValidationError"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/audit/verify": {
+      "get": {
+        "summary": "Verify the hash chain of the audit log",
+        "operationId": "verifyAudit",
+        "responses": {
+          "200": {"description": "the result of the verification", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuditVerification"}}}},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/accounts": {
+      "post": {
+        "summary": "Create a custodial account",
+        "operationId": "createAccountV2",
+        "responses": {
+          "200": {"description": "the account created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Account"}}}},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/bitmarks": {
+      "post": {
+        "summary": "Register an asset and issue bitmarks of it",
+        "description": "The content is either uploaded or read from asset_url on the host of the service.",
+        "operationId": "issueBitmarksV2",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/IssueRequest"}},
+            "multipart/form-data": {"schema": {"$ref": "#/components/schemas/IssueUpload"}}
+          }
+        },
+        "responses": {
+          "200": {"description": "the bitmarks issued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueResultV2"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/transfers": {
+      "post": {
+        "summary": "Countersign a transfer offered to a custodial account",
+        "operationId": "transferBitmarkV2",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransferRequestV2"}}}
+        },
+        "responses": {
+          "200": {"description": "the transfer submitted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransferResultV2"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "404": {"$ref": "#/components/responses/NotFoundV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/accounts/{accountNo}/bitmarks/{bitmarkId}/content": {
+      "get": {
+        "summary": "Download the decrypted asset of a bitmark",
+        "description": "Served unless account_downloads is turned off, in which case download tokens are used instead.",
+        "operationId": "downloadAssetV2",
+        "parameters": [
+          {"$ref": "#/components/parameters/AccountNo"},
+          {"$ref": "#/components/parameters/BitmarkId"},
+          {"$ref": "#/components/parameters/Disposition"},
+          {"$ref": "#/components/parameters/Range"},
+          {"$ref": "#/components/parameters/IfRange"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Content"},
+          "206": {"$ref": "#/components/responses/PartialContent"},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "404": {"$ref": "#/components/responses/NotFoundV2"},
+          "416": {"description": "the range can't be satisfied"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/downloads": {
+      "post": {
+        "summary": "Issue a signed download link",
+        "description": "The account must own the bitmark or have been granted access to it. When tls_client_ca is set, the client must present a verified certificate.",
+        "operationId": "issueDownloadTokenV2",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DownloadTokenRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "the download token", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DownloadToken"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "401": {"$ref": "#/components/responses/UnauthenticatedV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/assets/{assetId}/rekey": {
+      "post": {
+        "summary": "Re-encrypt an asset under a new data key",
+        "description": "Every bitmark of the asset must be held by the service.",
+        "operationId": "rekeyAssetV2",
+        "parameters": [{"$ref": "#/components/parameters/AssetId"}],
+        "responses": {
+          "200": {"description": "the bitmarks given the new data key", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RekeyResult"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "404": {"$ref": "#/components/responses/NotFoundV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/bitmarks/{bitmarkId}/grants": {
+      "parameters": [{"$ref": "#/components/parameters/BitmarkId"}],
+      "post": {
+        "summary": "Grant another account read access to the asset of a bitmark",
+        "operationId": "grantAccessV2",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GrantRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "the grant", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Grant"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "404": {"$ref": "#/components/responses/NotFoundV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      },
+      "get": {
+        "summary": "List the read access grants of a bitmark by grantee",
+        "operationId": "listAccessGrantsV2",
+        "parameters": [
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/PageLimit"}
+        ],
+        "responses": {
+          "200": {"description": "a page of grants", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GrantPage"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/bitmarks/{bitmarkId}/grants/{grantee}": {
+      "delete": {
+        "summary": "Revoke a read access grant by rotating the data key of the asset",
+        "operationId": "revokeAccessV2",
+        "parameters": [
+          {"$ref": "#/components/parameters/BitmarkId"},
+          {"name": "grantee", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/AccountNumber"}}
+        ],
+        "responses": {
+          "200": {"description": "the grant revoked", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Revocation"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "403": {"$ref": "#/components/responses/NotCustodialV2"},
+          "404": {"$ref": "#/components/responses/NotFoundV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/audit/records": {
+      "get": {
+        "summary": "List the audit records",
+        "operationId": "listAuditV2",
+        "parameters": [
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/PageLimit"},
+          {"name": "account", "in": "query", "schema": {"$ref": "#/components/schemas/AccountNumber"}},
+          {"name": "action", "in": "query", "schema": {"$ref": "#/components/schemas/AuditAction"}}
+        ],
+        "responses": {
+          "200": {"description": "a page of records", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuditPage"}}}},
+          "400": {"$ref": "#/components/responses/ValidationErrorV2"},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/audit/verification": {
+      "get": {
+        "summary": "Verify the hash chain of the audit log",
+        "operationId": "verifyAuditV2",
+        "responses": {
+          "200": {"description": "the result of the verification", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuditVerification"}}}},
+          "429": {"$ref": "#/components/responses/TooManyRequestsV2"},
+          "default": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/healthz": {
+      "servers": [{"url": "/"}],
+      "get": {
+        "summary": "Liveness of the service and its storage",
+        "operationId": "healthz",
+        "responses": {
+          "200": {"description": "healthy", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}},
+          "503": {"description": "unhealthy", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}}
+        }
+      }
+    },
+    "/readyz": {
+      "servers": [{"url": "/"}],
+      "get": {
+        "summary": "Readiness of the service and its dependencies",
+        "operationId": "readyz",
+        "responses": {
+          "200": {"description": "ready", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}},
+          "503": {"description": "a dependency is unavailable", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}}
+        }
+      }
+    },
+    "/metrics": {
+      "servers": [{"url": "/"}],
+      "get": {
+        "summary": "Metrics in the Prometheus text format",
+        "operationId": "metrics",
+        "responses": {
+          "200": {"description": "the metrics", "content": {"text/plain": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/openapi.json": {
+      "servers": [{"url": "/"}],
+      "get": {
+        "summary": "This specification",
+        "operationId": "openapi",
+        "responses": {
+          "200": {"description": "the OpenAPI document", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "AccountNo": {"name": "accountNo", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/AccountNumber"}},
+      "BitmarkId": {"name": "bitmarkId", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/BitmarkId"}},
+      "AssetId": {"name": "assetId", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/AssetId"}},
+      "Disposition": {"name": "disposition", "in": "query", "description": "inline to display the content in a browser", "schema": {"type": "string", "enum": ["attachment", "inline"], "default": "attachment"}},
+      "Range": {"name": "Range", "in": "header", "schema": {"type": "string"}, "example": "bytes=0-1023"},
+      "IfRange": {"name": "If-Range", "in": "header", "description": "ETag the range applies to", "schema": {"type": "string"}},
+      "PageLimit": {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}}
+    },
+    "headers": {
+      "RetryAfter": {"description": "seconds to wait before retrying", "schema": {"type": "integer"}}
+    },
+    "responses": {
+      "Content": {
+        "description": "the decrypted content",
+        "headers": {
+          "Content-Disposition": {"schema": {"type": "string"}},
+          "ETag": {"description": "fingerprint of the asset", "schema": {"type": "string"}},
+          "X-Content-Fingerprint": {"schema": {"type": "string"}},
+          "X-Content-Verified": {"schema": {"type": "string"}}
+        },
+        "content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}
+      },
+      "PartialContent": {
+        "description": "the requested range of the decrypted content",
+        "headers": {
+          "Content-Range": {"schema": {"type": "string"}},
+          "ETag": {"description": "fingerprint of the asset", "schema": {"type": "string"}}
+        },
+        "content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}
+      },
+      "ValidationError": {"description": "the request is malformed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unauthenticated": {"description": "the client presented no verified certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotCustodial": {"description": "the account is not held by the service or has no access", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "the resource does not exist", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "TooManyRequests": {
+        "description": "a rate limit or a daily quota is exceeded",
+        "headers": {"Retry-After": {"$ref": "#/components/headers/RetryAfter"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "Error": {"description": "the request failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "ValidationErrorV2": {"description": "the request is malformed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorV2"}}}},
+      "UnauthenticatedV2": {"description": "the client presented no verified certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorV2"}}}},
+      "NotCustodialV2": {"description": "the account is not held by the service or has no access", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorV2"}}}},
+      "NotFoundV2": {"description": "the resource does not exist", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorV2"}}}},
+      "TooManyRequestsV2": {
+        "description": "a rate limit or a daily quota is exceeded",
+        "headers": {"Retry-After": {"$ref": "#/components/headers/RetryAfter"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorV2"}}}
+      },
+      "ErrorV2": {"description": "the request failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorV2"}}}}
+    },
+    "schemas": {
+      "AccountNumber": {"type": "string", "description": "base58 encoded account number"},
+      "BitmarkId": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+      "AssetId": {"type": "string", "pattern": "^[0-9a-f]{128}$"},
+      "AuditAction": {
+        "type": "string",
+        "enum": ["create_account", "import_account", "export_account", "issue", "transfer", "download", "download_token", "rekey", "grant", "revoke"]
+      },
+      "ErrorCode": {
+        "type": "string",
+        "enum": ["validation_error", "not_found", "not_custodial", "unauthenticated", "forbidden", "upstream_unavailable", "upstream_rejected", "crypto_failure", "integrity_failure", "internal_error", "rate_limited", "quota_exceeded"]
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error", "code"],
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"$ref": "#/components/schemas/ErrorCode"},
+          "upstream_code": {"type": "integer", "description": "code reported by the Bitmark API"},
+          "fields": {"type": "object", "description": "the invalid fields of the request", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "ErrorV2": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {"$ref": "#/components/schemas/ErrorCode"},
+              "message": {"type": "string"},
+              "upstream_code": {"type": "integer", "description": "code reported by the Bitmark API"},
+              "fields": {
+                "type": "array",
+                "description": "the invalid fields of the request, by name",
+                "items": {
+                  "type": "object",
+                  "required": ["name", "message"],
+                  "properties": {"name": {"type": "string"}, "message": {"type": "string"}}
+                }
+              }
+            }
+          }
+        }
+      },
+      "Pagination": {
+        "type": "object",
+        "required": ["limit"],
+        "properties": {
+          "limit": {"type": "integer"},
+          "next_cursor": {"type": "string", "description": "cursor of the next page, omitted on the last page"}
+        }
+      },
+      "Account": {
+        "type": "object",
+        "required": ["account"],
+        "properties": {"account": {"$ref": "#/components/schemas/AccountNumber"}}
+      },
+      "IssueRequest": {
+        "type": "object",
+        "required": ["asset_url", "registrant", "name", "quantity"],
+        "properties": {
+          "asset_url": {"type": "string", "description": "path of the content on the host of the service"},
+          "registrant": {"$ref": "#/components/schemas/AccountNumber"},
+          "name": {"type": "string", "minLength": 1, "maxLength": 64},
+          "metadata": {"type": "object", "description": "up to 2048 characters when packed", "additionalProperties": {"type": "string"}},
+          "quantity": {"type": "integer", "minimum": 1, "maximum": 100}
+        }
+      },
+      "IssueUpload": {
+        "type": "object",
+        "required": ["registrant", "name", "quantity", "file"],
+        "properties": {
+          "registrant": {"$ref": "#/components/schemas/AccountNumber"},
+          "name": {"type": "string", "minLength": 1, "maxLength": 64},
+          "quantity": {"type": "integer", "minimum": 1, "maximum": 100},
+          "metadata": {"type": "string", "description": "JSON object of strings"},
+          "file": {"type": "string", "format": "binary", "description": "up to 100 MB"}
+        }
+      },
+      "IssueResult": {
+        "type": "object",
+        "required": ["bitmark_ids"],
+        "properties": {"bitmark_ids": {"type": "array", "items": {"$ref": "#/components/schemas/BitmarkId"}}}
+      },
+      "TransferRequest": {
+        "type": "object",
+        "required": ["txid", "owner"],
+        "properties": {
+          "txid": {"$ref": "#/components/schemas/BitmarkId"},
+          "owner": {"$ref": "#/components/schemas/AccountNumber"}
+        }
+      },
+      "TransferResult": {
+        "type": "object",
+        "required": ["txid"],
+        "properties": {"txid": {"type": "string"}}
+      },
+      "IssueResultV2": {
+        "type": "object",
+        "required": ["asset_id", "bitmarks"],
+        "properties": {
+          "asset_id": {"$ref": "#/components/schemas/AssetId"},
+          "bitmarks": {
+            "type": "array",
+            "items": {"type": "object", "required": ["id"], "properties": {"id": {"$ref": "#/components/schemas/BitmarkId"}}}
+          }
+        }
+      },
+      "TransferRequestV2": {
+        "type": "object",
+        "required": ["tx_id", "owner"],
+        "properties": {
+          "tx_id": {"$ref": "#/components/schemas/BitmarkId"},
+          "owner": {"$ref": "#/components/schemas/AccountNumber"}
+        }
+      },
+      "TransferResultV2": {
+        "type": "object",
+        "required": ["tx_id", "bitmark_id"],
+        "properties": {
+          "tx_id": {"type": "string"},
+          "bitmark_id": {"$ref": "#/components/schemas/BitmarkId"}
+        }
+      },
+      "DownloadTokenRequest": {
+        "type": "object",
+        "required": ["account", "bitmark_id"],
+        "properties": {
+          "account": {"$ref": "#/components/schemas/AccountNumber"},
+          "bitmark_id": {"$ref": "#/components/schemas/BitmarkId"},
+          "ttl": {"type": "integer", "minimum": 0, "maximum": 86400, "description": "lifetime in seconds, 300 if unset"},
+          "one_time": {"type": "boolean", "description": "serve the full content only once; ranged requests are served until the token expires"}
+        }
+      },
+      "DownloadToken": {
+        "type": "object",
+        "required": ["token", "url", "expires_at"],
+        "properties": {
+          "token": {"type": "string"},
+          "url": {"type": "string"},
+          "expires_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "RekeyResult": {
+        "type": "object",
+        "required": ["asset_id", "data_key_alg", "bitmark_ids"],
+        "properties": {
+          "asset_id": {"$ref": "#/components/schemas/AssetId"},
+          "data_key_alg": {"type": "string", "enum": ["xchacha20poly1305", "aes-256-gcm"]},
+          "bitmark_ids": {"type": "array", "items": {"$ref": "#/components/schemas/BitmarkId"}}
+        }
+      },
+      "GrantRequest": {
+        "type": "object",
+        "required": ["grantee"],
+        "properties": {"grantee": {"$ref": "#/components/schemas/AccountNumber"}}
+      },
+      "Grant": {
+        "type": "object",
+        "required": ["bitmark_id", "asset_id", "owner", "grantee", "created_at"],
+        "properties": {
+          "bitmark_id": {"$ref": "#/components/schemas/BitmarkId"},
+          "asset_id": {"$ref": "#/components/schemas/AssetId"},
+          "owner": {"$ref": "#/components/schemas/AccountNumber"},
+          "grantee": {"$ref": "#/components/schemas/AccountNumber"},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "GrantList": {
+        "type": "object",
+        "required": ["grants"],
+        "properties": {"grants": {"type": "array", "items": {"$ref": "#/components/schemas/Grant"}}}
+      },
+      "Revocation": {
+        "type": "object",
+        "required": ["revoked"],
+        "properties": {"revoked": {"$ref": "#/components/schemas/AccountNumber"}}
+      },
+      "AuditRecord": {
+        "type": "object",
+        "required": ["sequence", "timestamp", "action", "caller", "status", "prev_hash", "hash"],
+        "properties": {
+          "sequence": {"type": "integer"},
+          "timestamp": {"type": "string", "format": "date-time"},
+          "action": {"$ref": "#/components/schemas/AuditAction"},
+          "caller": {"type": "string", "description": "identity of the client certificate, or address of the client"},
+          "account": {"$ref": "#/components/schemas/AccountNumber"},
+          "params": {"type": "object", "additionalProperties": {"type": "string"}},
+          "result": {"type": "object", "additionalProperties": {"type": "string"}},
+          "status": {"type": "string"},
+          "error": {"type": "string"},
+          "prev_hash": {"type": "string"},
+          "hash": {"type": "string"}
+        }
+      },
+      "AuditList": {
+        "type": "object",
+        "required": ["records"],
+        "properties": {"records": {"type": "array", "items": {"$ref": "#/components/schemas/AuditRecord"}}}
+      },
+      "AuditPage": {
+        "type": "object",
+        "required": ["data", "pagination"],
+        "properties": {
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/AuditRecord"}},
+          "pagination": {"$ref": "#/components/schemas/Pagination"}
+        }
+      },
+      "GrantPage": {
+        "type": "object",
+        "required": ["data", "pagination"],
+        "properties": {
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/Grant"}},
+          "pagination": {"$ref": "#/components/schemas/Pagination"}
+        }
+      },
+      "AuditVerification": {
+        "type": "object",
+        "required": ["valid", "records"],
+        "properties": {
+          "valid": {"type": "boolean"},
+          "records": {"type": "integer", "description": "number of records verified"},
+          "broken_at": {"type": "integer", "description": "sequence number of the first broken record"},
+          "reason": {"type": "string"}
+        }
+      },
+      "Health": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unavailable"]},
+          "error": {"type": "string"}
+        }
+      },
+      "DependencyStatus": {
+        "type": "object",
+        "required": ["status", "latency", "checked_at"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unavailable"]},
+          "error": {"type": "string"},
+          "latency": {"type": "string"},
+          "checked_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Readiness": {
+        "type": "object",
+        "required": ["status", "dependencies"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unavailable"]},
+          "dependencies": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/DependencyStatus"}}
+        }
+      }
+    }
+  }
+}`
+
+// openAPIDocument is the compacted specification served
+var openAPIDocument = compactOpenAPISpec()
+
+func compactOpenAPISpec() []byte {
+	var b bytes.Buffer
+	if err := json.Compact(&b, []byte(openAPISpec)); err != nil {
+		panic(fmt.Sprintf("malformed OpenAPI specification: %s", err))
+	}
+	return b.Bytes()
+}
+
+func serveOpenAPISpec() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIDocument)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type specNode map[string]interface{}
+
+func loadOpenAPISpec(t *testing.T) specNode {
+	var spec specNode
+	if err := json.Unmarshal([]byte(openAPISpec), &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func (n specNode) node(name string) specNode {
+	child, _ := n[name].(map[string]interface{})
+	return specNode(child)
+}
+
+// resolve follows the references of the node within the spec
+func (spec specNode) resolve(n specNode) specNode {
+	for {
+		ref, ok := n["$ref"].(string)
+		if !ok {
+			return n
+		}
+		n = spec
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			n = n.node(name)
+		}
+	}
+}
+
+// operation returns the path of the spec documenting the route and
+// its operation. The routes without a version prefix are documented
+// under /v1, and the network prefixes are left out.
+func (spec specNode) operation(method, route string) (string, specNode) {
+	for name := range networks {
+		if strings.HasPrefix(route, "/"+string(name)+"/") {
+			route = strings.TrimPrefix(route, "/"+string(name))
+			break
+		}
+	}
+
+	segments := strings.Split(route, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	route = strings.Join(segments, "/")
+
+	paths := spec.node("paths")
+	for _, path := range []string{route, "/v1" + route} {
+		if op := paths.node(path).node(strings.ToLower(method)); op != nil {
+			return path, op
+		}
+	}
+	return "", nil
+}
+
+// validate checks the value against the subset of JSON Schema the
+// spec uses, and returns the violations found
+func (spec specNode) validate(schema specNode, v interface{}, at string) []string {
+	schema = spec.resolve(schema)
+
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			fail("%v is not one of %v", v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected an object, got %T", v)
+			break
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				fail("missing %s", name)
+			}
+		}
+		props := schema.node("properties")
+		for name, value := range obj {
+			if prop := props.node(name); prop != nil {
+				errs = append(errs, spec.validate(prop, value, at+"."+name)...)
+			} else if extra := schema.node("additionalProperties"); extra != nil {
+				errs = append(errs, spec.validate(extra, value, at+"."+name)...)
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			fail("expected an array, got %T", v)
+			break
+		}
+		for i, item := range items {
+			errs = append(errs, spec.validate(schema.node("items"), item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			fail("expected a string, got %T", v)
+			break
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			fail("%q does not match %s", s, pattern)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				fail("%q is not a date-time", s)
+			}
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			fail("expected an integer, got %v", v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("expected a boolean, got %T", v)
+		}
+	}
+
+	return errs
+}
+
+// checkResponse validates the status and the body of the response
+// against those documented for the operation
+func (spec specNode) checkResponse(t *testing.T, op specNode, w *httptest.ResponseRecorder, name string) {
+	responses := op.node("responses")
+	response := responses.node(fmt.Sprint(w.Code))
+	if response == nil {
+		response = responses.node("default")
+	}
+	if response == nil {
+		t.Errorf("%s: status %d is not documented", name, w.Code)
+		return
+	}
+
+	content := spec.resolve(response).node("content")
+	if content == nil {
+		return
+	}
+
+	contentType := strings.Split(w.Header().Get("Content-Type"), ";")[0]
+	media := content.node(contentType)
+	if media == nil {
+		media = content.node("*/*")
+	}
+	if media == nil {
+		t.Errorf("%s: content type %q is not documented", name, contentType)
+		return
+	}
+	if contentType != "application/json" {
+		return
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Errorf("%s: malformed body: %s", name, err)
+		return
+	}
+	for _, err := range spec.validate(media.node("schema"), body, "body") {
+		t.Errorf("%s: %s", name, err)
+	}
+}
+
+// exercise serves the request and checks the response against the
+// operation documenting the route, which is marked as exercised
+func (spec specNode) exercise(t *testing.T, r *gin.Engine, exercised map[string]bool, method, target, body string, status int) *httptest.ResponseRecorder {
+	name := method + " " + target
+
+	var route string
+	for _, info := range r.Routes() {
+		if info.Method == method && matchRoute(info.Path, strings.Split(target, "?")[0]) {
+			route = info.Path
+		}
+	}
+	path, op := spec.operation(method, route)
+	if op == nil {
+		t.Errorf("%s: no documented route", name)
+		return nil
+	}
+	exercised[strings.ToLower(method)+" "+path] = true
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if assert.Equal(t, status, w.Code, "%s: %s", name, w.Body.String()) {
+		spec.checkResponse(t, op, w, name)
+	}
+	return w
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	for _, route := range newRouter().Routes() {
+		if path, _ := spec.operation(route.Method, route.Path); path == "" {
+			t.Errorf("%s %s is not documented", route.Method, route.Path)
+		}
+	}
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	defer openTestBoltStorage(t)()
+	defer func(l *rateLimits) { limits = l }(limits)
+	initRateLimits(&config{})
+
+	// the downloads are restricted to document their error responses
+	defer func(enabled, verify bool) {
+		accountDownloads, verifyClientCertificates = enabled, verify
+	}(accountDownloads, verifyClientCertificates)
+	accountDownloads, verifyClientCertificates = false, true
+
+	spec := loadOpenAPISpec(t)
+	r := newRouter()
+
+	// the account creation needs the key server, so the client is
+	// held back by its rate limit instead
+	exhausted := newRateLimiter(1e-6, 1)
+	exhausted.take("192.0.2.1")
+	limits.routes["account"] = exhausted
+
+	bitmarkId := strings.Repeat("a", bitmarkIdLength)
+	assert.NoError(t, storage.Grants().Put(&Grant{
+		BitmarkId: bitmarkId,
+		AssetId:   strings.Repeat("b", assetIdLength),
+		Owner:     "owner",
+		Grantee:   "grantee",
+		CreatedAt: time.Now().UTC(),
+	}))
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/v1/account", "", http.StatusTooManyRequests},
+		{"POST", "/v1/issue", "{}", http.StatusBadRequest},
+		{"POST", "/v1/transfer", "{}", http.StatusBadRequest},
+		{"GET", "/v1/assets/account/" + bitmarkId, "", http.StatusForbidden},
+		{"POST", "/v1/downloads", "{}", http.StatusUnauthorized},
+		{"GET", "/downloads/token", "", http.StatusBadRequest},
+		{"POST", "/v1/assets/asset/rekey", "", http.StatusBadRequest},
+		{"POST", "/v1/bitmarks/bitmark/grants", "{}", http.StatusBadRequest},
+		{"GET", "/v1/bitmarks/" + bitmarkId + "/grants", "", http.StatusOK},
+		{"DELETE", "/v1/bitmarks/bitmark/grants/grantee", "", http.StatusBadRequest},
+		{"GET", "/v1/audit", "", http.StatusOK},
+		{"GET", "/v1/audit/verify", "", http.StatusOK},
+
+		{"POST", "/v2/accounts", "", http.StatusTooManyRequests},
+		{"POST", "/v2/bitmarks", "{}", http.StatusBadRequest},
+		{"POST", "/v2/transfers", "{}", http.StatusBadRequest},
+		{"GET", "/v2/accounts/account/bitmarks/" + bitmarkId + "/content", "", http.StatusForbidden},
+		{"POST", "/v2/downloads", "{}", http.StatusUnauthorized},
+		{"POST", "/v2/assets/asset/rekey", "", http.StatusBadRequest},
+		{"POST", "/v2/bitmarks/bitmark/grants", "{}", http.StatusBadRequest},
+		{"GET", "/v2/bitmarks/" + bitmarkId + "/grants", "", http.StatusOK},
+		{"DELETE", "/v2/bitmarks/bitmark/grants/grantee", "", http.StatusBadRequest},
+		{"GET", "/v2/audit/records", "", http.StatusOK},
+		{"GET", "/v2/audit/verification", "", http.StatusOK},
+
+		// the deprecated and the network routes share the operations
+		{"POST", "/issue", "{}", http.StatusBadRequest},
+		{"GET", "/testnet/v2/audit/records?limit=1", "", http.StatusOK},
+
+		{"GET", "/healthz", "", http.StatusOK},
+		{"GET", "/readyz", "", http.StatusOK},
+		{"GET", "/metrics", "", http.StatusOK},
+		{"GET", "/openapi.json", "", http.StatusOK},
+	}
+
+	exercised := make(map[string]bool)
+	for _, tc := range cases {
+		spec.exercise(t, r, exercised, tc.method, tc.path, tc.body, tc.status)
+	}
+
+	var missing []string
+	for path := range spec.node("paths") {
+		for method := range spec.node("paths").node(path) {
+			if method != "servers" && method != "parameters" && !exercised[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	assert.Empty(t, missing, "operations without a contract case")
+}
+
+func TestOpenAPIValidate(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	schema := specNode{"$ref": "#/components/schemas/Error"}
+
+	var valid, invalid interface{}
+	json.Unmarshal([]byte(`{"error": "failed", "code": "not_found"}`), &valid)
+	json.Unmarshal([]byte(`{"error": 1, "code": "missing", "fields": {"a": 2}}`), &invalid)
+
+	assert.Empty(t, spec.validate(schema, valid, "body"))
+	assert.Equal(t, []string{
+		`body.code: missing is not one of`,
+		`body.error: expected a string, got float64`,
+		`body.fields.a: expected a string, got float64`,
+	}, truncateViolations(spec.validate(schema, invalid, "body")))
+}
+
+// truncateViolations drops the enumerations listed by the violations and
+// sorts them, since the properties are walked in random order
+func truncateViolations(errs []string) []string {
+	for i, err := range errs {
+		if n := strings.Index(err, " one of "); n >= 0 {
+			errs[i] = err[:n+len(" one of")]
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// TestOpenAPIContractSuccess validates the successful responses of the
+// operations served with the upstream, which is stubbed
+func TestOpenAPIContractSuccess(t *testing.T) {
+	stub, done := useUpstreamStub(t)
+	defer done()
+	defer func(l *rateLimits) { limits = l }(limits)
+	initRateLimits(&config{})
+	assert.NoError(t, initDownloadSecret("secret"))
+
+	content := []byte("asset content")
+	file, err := ioutil.TempFile("", "asset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(content)
+	file.Close()
+
+	spec := loadOpenAPISpec(t)
+	r := newRouter()
+	exercised := make(map[string]bool)
+	call := func(method, target, body string) map[string]interface{} {
+		var result map[string]interface{}
+		if w := spec.exercise(t, r, exercised, method, target, body, http.StatusOK); w != nil {
+			json.Unmarshal(w.Body.Bytes(), &result)
+		}
+		return result
+	}
+
+	routes := []struct {
+		prefix, account, issue, transfer, txId, content string
+	}{
+		{"/v1", "/account", "/issue", "/transfer", "txid", "/assets/%s/%s"},
+		{"/v2", "/accounts", "/bitmarks", "/transfers", "tx_id", "/accounts/%s/bitmarks/%s/content"},
+	}
+	for i, v := range routes {
+		owner, _ := call("POST", v.prefix+v.account, "")["account"].(string)
+		recipient, _ := call("POST", v.prefix+v.account, "")["account"].(string)
+		if t.Failed() {
+			return
+		}
+
+		// the content differs on each version, so that another asset is issued
+		file, _ := os.OpenFile(file.Name(), os.O_APPEND|os.O_WRONLY, 0600)
+		fmt.Fprint(file, i)
+		file.Close()
+
+		issued := call("POST", v.prefix+v.issue, fmt.Sprintf(`{"asset_url": "file://%s", "registrant": "%s", "name": "asset", "quantity": 1}`, file.Name(), owner))
+		var bitmarkId string
+		if v.prefix == "/v1" {
+			ids, _ := issued["bitmark_ids"].([]interface{})
+			if !assert.Len(t, ids, 1) {
+				return
+			}
+			bitmarkId = ids[0].(string)
+		} else {
+			bitmarks, _ := issued["bitmarks"].([]interface{})
+			if !assert.Len(t, bitmarks, 1) {
+				return
+			}
+			bitmarkId = bitmarks[0].(map[string]interface{})["id"].(string)
+		}
+
+		stub.Lock()
+		assetId, txId := stub.bitmarks[bitmarkId].AssetId, stub.bitmarks[bitmarkId].LatestTxId
+		stub.Unlock()
+
+		call("GET", v.prefix+fmt.Sprintf(v.content, owner, bitmarkId), "")
+		token := call("POST", v.prefix+"/downloads", fmt.Sprintf(`{"account": "%s", "bitmark_id": "%s"}`, owner, bitmarkId))
+		if url, ok := token["url"].(string); assert.True(t, ok) {
+			call("GET", url, "")
+		}
+
+		call("POST", v.prefix+"/bitmarks/"+bitmarkId+"/grants", fmt.Sprintf(`{"grantee": "%s"}`, recipient))
+		call("DELETE", v.prefix+"/bitmarks/"+bitmarkId+"/grants/"+recipient, "")
+		call("POST", v.prefix+"/assets/"+assetId+"/rekey", "")
+		call("POST", v.prefix+v.transfer, fmt.Sprintf(`{"%s": "%s", "owner": "%s"}`, v.txId, txId, recipient))
+	}
+
+	assert.Len(t, exercised, 17)
+}
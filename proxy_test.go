@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1/32", "10.0.0.0/8", "::1/128"},
+		[]string{nets[0].String(), nets[1].String(), nets[2].String()})
+
+	_, err = parseTrustedProxies([]string{"proxy"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestClientAddress(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:4242"
+	req.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+
+	// the header is ignored without trusted proxies
+	trustedProxies = nil
+	assert.Equal(t, "10.0.0.2", clientAddress(req))
+
+	// the addresses before the first untrusted one may be forged
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8"})
+	assert.Equal(t, "2.2.2.2", clientAddress(req))
+
+	// the header of an untrusted peer is ignored
+	req.RemoteAddr = "3.3.3.3:4242"
+	assert.Equal(t, "3.3.3.3", clientAddress(req))
+
+	// a request from the proxy itself
+	req.RemoteAddr = "10.0.0.2:4242"
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.2", clientAddress(req))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	quotaIssue    = "issue"
+	quotaAccounts = "account"
+
+	// idle buckets are dropped once they have refilled
+	limiterSweepInterval = time.Minute
+)
+
+// tokenBucket holds the tokens left to a client as of the last request
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter grants each key rate requests per second on average,
+// with bursts of up to burst requests
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+		if burst < 1 {
+			burst = 1
+		}
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// take consumes a token of the key, or returns how long to wait
+// for the next one
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) > limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// rateLimits holds the limits configured for the API clients.
+// Unset limits are not enforced.
+type rateLimits struct {
+	client *rateLimiter
+	routes map[string]*rateLimiter
+	quotas map[string]int64
+}
+
+var limits = &rateLimits{}
+
+// initRateLimits sets up the limits of the configuration. The client
+// rate is given per second and the route rates per minute.
+func initRateLimits(cfg *config) {
+	limits = &rateLimits{
+		routes: make(map[string]*rateLimiter),
+		quotas: map[string]int64{
+			quotaIssue:    cfg.DailyIssueQuota,
+			quotaAccounts: cfg.DailyAccountQuota,
+		},
+	}
+
+	if cfg.RateLimit > 0 {
+		limits.client = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	for route, perMinute := range cfg.RouteRateLimits {
+		if perMinute > 0 {
+			limits.routes[route] = newRateLimiter(perMinute/60, int(math.Ceil(perMinute)))
+		}
+	}
+}
+
+// limitClient turns down the requests of a client beyond its rate
+func limitClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limits.client == nil {
+			return
+		}
+
+		if ok, wait := limits.client.take(callerIdentity(c)); !ok {
+			abortWithError(c, rateLimitedError(wait))
+		}
+	}
+}
+
+// limitRoute turns down the requests of a client to the route
+// beyond the rate configured for it
+func limitRoute(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		l, ok := limits.routes[route]
+		if !ok {
+			return
+		}
+
+		if ok, wait := l.take(callerIdentity(c)); !ok {
+			abortWithError(c, rateLimitedError(wait))
+		}
+	}
+}
+
+// consumeQuota counts amount against the daily quota of the client and
+// of the given owners. Nothing is counted if any of them would exceed
+// the quota. The days are in UTC. The function returned takes the
+// amount back, for the operations which fail.
+func consumeQuota(c *gin.Context, quota string, amount int64, owners ...string) (refund func(), err error) {
+	refund = func() {}
+
+	limit := limits.quotas[quota]
+	if limit <= 0 {
+		return refund, nil
+	}
+
+	now := time.Now().UTC()
+	keys := []string{quota + "|client:" + callerIdentity(c)}
+	for _, owner := range owners {
+		keys = append(keys, quota+"|"+owner)
+	}
+
+	day := now.Format("2006-01-02")
+	ok, err := storage.Quotas().Consume(day, keys, amount, limit)
+	if err != nil {
+		return refund, internalError("failed to update the %s quota: %s", quota, err)
+	}
+	if !ok {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return refund, quotaExceededError(quota, limit, midnight.Sub(now))
+	}
+
+	refund = func() {
+		if err := storage.Quotas().Refund(day, keys, amount); err != nil {
+			log.Errorf("failed to refund the %s quota: %s", quota, err)
+		}
+	}
+	return refund, nil
+}
+
+// refundOnFailure takes the quota back if the handler responded with
+// an error
+func refundOnFailure(c *gin.Context, refund func()) {
+	if c.IsAborted() || c.Writer.Status() >= http.StatusBadRequest {
+		refund()
+	}
+}
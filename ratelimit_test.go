@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueQuotaRefundedOnFailure(t *testing.T) {
+	defer openTestBoltStorage(t)()
+	defer func(l *rateLimits) { limits = l }(limits)
+	initRateLimits(&config{DailyIssueQuota: 5})
+
+	acct, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addAccount(acct); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/issue", issueBitmarks())
+
+	// the asset file is read after the quota is consumed
+	body := `{"registrant": "` + acct.AccountNumber() + `", "asset_url": "file:///nonexistent/asset", "name": "asset", "quantity": 5}`
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/issue", strings.NewReader(body))
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "unable to read asset file")
+	}
+
+	// the whole quota is left for the registrant
+	ok, err := storage.Quotas().Consume(time.Now().UTC().Format("2006-01-02"),
+		[]string{quotaIssue + "|account:" + acct.AccountNumber()}, 5, 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
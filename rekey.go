@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// the sharing of the new data key is retried before giving up
+	rekeyShareAttempts = 3
+	rekeyShareBackoff  = time.Second
+
+	// bitmarks listed per page, the most the API serves
+	rekeyPageSize = 100
+)
+
+type rekeyResult struct {
+	AssetId   string   `json:"asset_id"`
+	Algorithm string   `json:"data_key_alg"`
+	Bitmarks  []string `json:"bitmark_ids"`
+}
+
+// reencryptAsset re-encrypts the content of the asset under a new data key
+// and shares the new key with the current owners and their grantees only,
+// so that the previous owners are no longer able to decrypt the content.
+// It requires every bitmark of the asset to be held by this service.
+// When the key can't be shared for some of the bitmarks, the result
+// lists those updated and the error the others. The re-encryptions of
+// an asset are serialized across the instances sharing the storage.
+func reencryptAsset(ctx context.Context, assetId string) (*rekeyResult, error) {
+	var result *rekeyResult
+	err := storage.Lock(ctx, "rekey/"+assetId, func() error {
+		var err error
+		result, err = rekeyContent(ctx, assetId)
+		return err
+	})
+	return result, err
+}
+
+// listAssetBitmarks reads every page of the bitmarks of the asset. The
+// pages are read until one brings no bitmark not seen before.
+func listAssetBitmarks(assetId string) ([]*bitmark.Bitmark, error) {
+	var bitmarks []*bitmark.Bitmark
+	seen := make(map[string]bool)
+
+	it := bitmark.NewIterator(bitmark.NewQueryParamsBuilder().ReferencedAsset(assetId).Limit(rekeyPageSize))
+	for it.Before() {
+		added := false
+		for _, b := range it.Values() {
+			if !seen[b.Id] {
+				seen[b.Id] = true
+				bitmarks = append(bitmarks, b)
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, upstreamError(err, "failed to list the bitmarks of the asset %s", assetId)
+	}
+	return bitmarks, nil
+}
+
+func rekeyContent(ctx context.Context, assetId string) (*rekeyResult, error) {
+	bitmarks, err := listAssetBitmarks(assetId)
+	if err != nil {
+		return nil, err
+	}
+	if len(bitmarks) == 0 {
+		return nil, notFoundError("no bitmarks found for the asset %s", assetId)
+	}
+
+	// every bitmark is held by this service before anything is replaced
+	owners := make(map[string]account.Account)
+	for _, b := range bitmarks {
+		if _, ok := owners[b.Owner]; ok {
+			continue
+		}
+		acct, err := getAccount(b.Owner)
+		if err != nil {
+			return nil, err
+		}
+		owners[b.Owner] = acct
+	}
+
+	a, err := asset.Get(assetId)
+	if err != nil {
+		return nil, upstreamError(err, "failed to query the asset %s", assetId)
+	}
+	if a == nil {
+		return nil, notFoundError("asset %s not found", assetId)
+	}
+
+	uploader := owners[bitmarks[0].Owner]
+	fileName, plaintext, err := decryptAsset(ctx, uploader, bitmarks[0].Id, bitmarks[0].Owner, a)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		return nil, cryptoError("failed to generate the data key: %s", err)
+	}
+
+	if err := service.uploadAsset(ctx, uploader, assetId, fileName, plaintext, dataKey); err != nil {
+		return nil, err
+	}
+	assetCache.remove(assetCacheKey(assetId))
+	dataKeys.removeAsset(assetId)
+
+	result := &rekeyResult{
+		AssetId:   assetId,
+		Algorithm: dataKey.Algorithm(),
+		Bitmarks:  make([]string, 0, len(bitmarks)),
+	}
+
+	// the content is replaced already, so every bitmark is tried and
+	// those left without the new key are reported
+	var (
+		pending []string
+		lastErr error
+	)
+	for _, b := range bitmarks {
+		if err := shareRekeyedBitmark(ctx, owners[b.Owner], b, dataKey); err != nil {
+			log.Errorf("unable to share the new data key of the bitmark %s: %s", b.Id, err)
+			pending = append(pending, b.Id)
+			lastErr = err
+			continue
+		}
+		result.Bitmarks = append(result.Bitmarks, b.Id)
+	}
+
+	if len(pending) > 0 {
+		e := upstreamError(lastErr, "asset %s re-encrypted, but the new data key was shared for the bitmarks [%s] only and not for [%s], rekey the asset again",
+			assetId, strings.Join(result.Bitmarks, ", "), strings.Join(pending, ", "))
+		return result, e
+	}
+
+	log.Infof("asset %s re-encrypted for %d bitmarks", assetId, len(result.Bitmarks))
+	return result, nil
+}
+
+// shareRekeyedBitmark shares the new data key with the owner of the
+// bitmark and the accounts the owner granted access. The owner signs
+// the session data, as for transfers and grants.
+func shareRekeyedBitmark(ctx context.Context, owner account.Account, b *bitmark.Bitmark, dataKey DataKey) error {
+	recipients := []string{b.Owner}
+
+	// keep the access granted by the current owner only
+	grants, err := listGrants(b.Id)
+	if err != nil {
+		return internalError("failed to read the grants: %s", err)
+	}
+	for _, g := range grants {
+		if g.Owner == b.Owner {
+			recipients = append(recipients, g.Grantee)
+		}
+	}
+
+	for _, recipient := range recipients {
+		for attempt := 1; ; attempt++ {
+			err := shareDataKey(ctx, owner, b.Id, recipient, dataKey)
+			if err == nil {
+				break
+			}
+			if attempt == rekeyShareAttempts {
+				return err
+			}
+			time.Sleep(rekeyShareBackoff)
+		}
+	}
+	return nil
+}
+
+func rekeyAsset() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		assetId := c.Param("assetId")
+		auditParam(c, "asset_id", assetId)
+
+		if err := validateHexId(assetId, assetIdLength); err != nil {
+			fields := fieldErrors{}
+			fields.add("assetId", err.Error())
+			abortWithError(c, fields.err())
+			return
+		}
+
+		result, err := reencryptAsset(c.Request.Context(), assetId)
+		if result != nil {
+			auditResult(c, "data_key_alg", result.Algorithm)
+			auditResult(c, "bitmarks", strconv.Itoa(len(result.Bitmarks)))
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRekeyPagesThroughEveryBitmark(t *testing.T) {
+	stub, done := useUpstreamStub(t)
+	defer done()
+
+	owner := stub.newAccount(t)
+	content := []byte("asset content")
+	a := stub.addAsset(t, owner, content)
+
+	var ids []string
+	for i := 0; i < rekeyPageSize+50; i++ {
+		ids = append(ids, stub.addBitmark(a.Id, owner.AccountNumber()).Id)
+	}
+	earliest := ids[0]
+
+	result, err := reencryptAsset(context.Background(), a.Id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sort.Strings(ids)
+	sort.Strings(result.Bitmarks)
+	assert.Equal(t, ids, result.Bitmarks)
+	assert.Equal(t, 3, stub.listPages)
+	assert.Equal(t, 2, stub.uploads)
+
+	// the earliest bitmark, on the last page, got the new key
+	loaded, err := loadAsset(context.Background(), owner.AccountNumber(), earliest)
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, loaded.plaintext)
+	}
+}
+
+func TestRekeyChecksTheCustodyOfEveryPage(t *testing.T) {
+	stub, done := useUpstreamStub(t)
+	defer done()
+
+	owner := stub.newAccount(t)
+	outsider, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := stub.addAsset(t, owner, []byte("asset content"))
+
+	// the earliest bitmark is listed on the last page
+	stub.addBitmark(a.Id, outsider.AccountNumber())
+	for i := 0; i < rekeyPageSize+50; i++ {
+		stub.addBitmark(a.Id, owner.AccountNumber())
+	}
+
+	_, err = reencryptAsset(context.Background(), a.Id)
+	if assert.Error(t, err) {
+		assert.Equal(t, ErrCodeNotCustodial, err.(*TradeError).Code)
+	}
+	assert.Equal(t, 1, stub.uploads, "the content was replaced")
+}
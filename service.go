@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -23,12 +24,22 @@ type Service struct {
 	keyEndpoint string
 }
 
-func (s *Service) newAPIRequest(method, path string, body io.Reader) (*http.Request, error) {
-	return http.NewRequest(method, s.apiEndpoint+path, body)
+// newRequest creates a request carrying the context of the caller, so
+// that the gate is left while the request waits for the upstream
+func newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
 }
 
-func (s *Service) newSignedAPIRequest(method, path string, body io.Reader, acct account.Account, parts ...string) (*http.Request, error) {
-	req, err := http.NewRequest(method, s.apiEndpoint+path, body)
+func (s *Service) newAPIRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	return newRequest(ctx, method, s.apiEndpoint+path, body)
+}
+
+func (s *Service) newSignedAPIRequest(ctx context.Context, method, path string, body io.Reader, acct account.Account, parts ...string) (*http.Request, error) {
+	req, err := newRequest(ctx, method, s.apiEndpoint+path, body)
 	if err != nil {
 		return nil, err
 	}
@@ -45,8 +56,8 @@ func (s *Service) newSignedAPIRequest(method, path string, body io.Reader, acct
 	return req, nil
 }
 
-func (s *Service) newKeyRequest(method, path string, body io.Reader) (*http.Request, error) {
-	return http.NewRequest(method, s.keyEndpoint+path, body)
+func (s *Service) newKeyRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	return newRequest(ctx, method, s.keyEndpoint+path, body)
 }
 
 func (s *Service) submitRequest(req *http.Request, result interface{}) ([]byte, error) {
@@ -62,9 +73,9 @@ func (s *Service) submitRequest(req *http.Request, result interface{}) ([]byte,
 	}
 
 	if resp.StatusCode/100 != 2 {
-		var se ServiceError
+		se := ServiceError{StatusCode: resp.StatusCode}
 		if e := json.Unmarshal(data, &se); e != nil {
-			return nil, fmt.Errorf("unexpected response: %s", string(data))
+			se.Message = fmt.Sprintf("unexpected response: %s", string(data))
 		}
 		return nil, &se
 	}
@@ -78,7 +89,7 @@ func (s *Service) submitRequest(req *http.Request, result interface{}) ([]byte,
 	return data, nil
 }
 
-func (s *Service) uploadAsset(acct account.Account, assetId string, fileName string, fileContent []byte) error {
+func (s *Service) uploadAsset(ctx context.Context, acct account.Account, assetId string, fileName string, fileContent []byte, dataKey DataKey) error {
 	body := new(bytes.Buffer)
 
 	bodyWriter := multipart.NewWriter(body)
@@ -87,37 +98,39 @@ func (s *Service) uploadAsset(acct account.Account, assetId string, fileName str
 
 	fileWriter, err := bodyWriter.CreateFormFile("file", fileName)
 	if err != nil {
-		return err
+		return internalError("failed to prepare the asset upload: %s", err)
 	}
 
-	dataKey, e := NewDataKey()
-	if e != nil {
-		return err
-	}
-	encryptedContent, e := dataKey.Encrypt(fileContent)
-	if e != nil {
-		return err
+	encryptedContent, err := dataKey.Encrypt(fileContent, []byte(assetId))
+	if err != nil {
+		return cryptoError("failed to encrypt the asset: %s", err)
 	}
 	encrKey := getEncrKey(acct)
-	sessData, e := createSessionData(acct, dataKey, encrKey.PublicKeyBytes())
-	if e != nil {
+	sessData, err := createSessionData(acct, dataKey, encrKey.PublicKeyBytes())
+	if err != nil {
 		return err
 	}
-	if _, e := fileWriter.Write(encryptedContent); e != nil {
-		return err
+	cryptoBytes.Add(float64(len(fileContent)), "encrypt")
+	if _, err := fileWriter.Write(encryptedContent); err != nil {
+		return internalError("failed to prepare the asset upload: %s", err)
 	}
 	bodyWriter.WriteField("session_data", sessData.String())
 
 	err = bodyWriter.Close()
 	if err != nil {
-		return err
+		return internalError("failed to prepare the asset upload: %s", err)
 	}
 
-	req, _ := s.newSignedAPIRequest("POST", "/v1/assets", body, acct, "uploadAsset", assetId)
+	req, _ := s.newSignedAPIRequest(ctx, "POST", "/v1/assets", body, acct, "uploadAsset", assetId)
 	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
 
+	start := time.Now()
 	_, err = s.submitRequest(req, nil)
-	return err
+	observeUpstream("uploadAsset", start, err)
+	if err != nil {
+		return upstreamError(err, "failed to upload the asset")
+	}
+	return nil
 }
 
 type access struct {
@@ -126,25 +139,36 @@ type access struct {
 	Sender   string       `json:"sender"`
 }
 
-func (s *Service) getAssetAccess(acct account.Account, bitmarkId string) (*access, error) {
-	req, _ := s.newSignedAPIRequest("GET", fmt.Sprintf("/v1/bitmarks/%s/asset", bitmarkId), nil, acct, "downloadAsset", bitmarkId)
+func (s *Service) getAssetAccess(ctx context.Context, acct account.Account, bitmarkId string) (*access, error) {
+	req, _ := s.newSignedAPIRequest(ctx, "GET", fmt.Sprintf("/v1/bitmarks/%s/asset", bitmarkId), nil, acct, "downloadAsset", bitmarkId)
 
 	var result access
-	if _, err := s.submitRequest(req, &result); err != nil {
-		return nil, fmt.Errorf("failed to get the asset access: %s", err.Error())
+	start := time.Now()
+	_, err := s.submitRequest(req, &result)
+	observeUpstream("getAssetAccess", start, err)
+	if err != nil {
+		return nil, upstreamError(err, "failed to get the asset access")
 	}
 
 	return &result, nil
 }
 
-func (s *Service) getAssetContent(url string) (string, []byte, error) {
-	req, _ := http.NewRequest("GET", url, nil)
+func (s *Service) getAssetContent(ctx context.Context, url string) (string, []byte, error) {
+	req, _ := newRequest(ctx, "GET", url, nil)
+	start := time.Now()
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return "", nil, err
+		observeUpstream("getAssetContent", start, err)
+		return "", nil, upstreamError(err, "failed to get the asset content")
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode/100 != 2 {
+		err := &ServiceError{StatusCode: resp.StatusCode, Message: resp.Status}
+		observeUpstream("getAssetContent", start, err)
+		return "", nil, upstreamError(err, "failed to get the asset content")
+	}
+
 	var filename string
 	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
 	name, ok := params["filename"]
@@ -153,53 +177,67 @@ func (s *Service) getAssetContent(url string) (string, []byte, error) {
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
+	observeUpstream("getAssetContent", start, err)
 	if err != nil {
-		return "", nil, err
+		return "", nil, upstreamError(err, "failed to get the asset content")
 	}
 
 	return filename, data, nil
 }
 
-func (s *Service) addSessionData(acct account.Account, bitmarkId, receiver string, data *SessionData) error {
+func (s *Service) addSessionData(ctx context.Context, acct account.Account, bitmarkId, receiver string, data *SessionData) error {
 	body := toJSONRequestBody(map[string]interface{}{
 		"bitmark_id":   bitmarkId,
 		"owner":        receiver,
 		"session_data": data,
 	})
-	req, _ := s.newSignedAPIRequest("POST", "/v2/session", body, acct, "updateSession", data.String())
+	req, _ := s.newSignedAPIRequest(ctx, "POST", "/v2/session", body, acct, "updateSession", data.String())
 
-	if _, err := s.submitRequest(req, nil); err != nil {
-		return fmt.Errorf("failed to add session data for %s: %s", receiver, err.Error())
+	start := time.Now()
+	_, err := s.submitRequest(req, nil)
+	observeUpstream("addSessionData", start, err)
+	if err != nil {
+		return upstreamError(err, "failed to add session data for %s", receiver)
 	}
 	return nil
 }
 
-func (s *Service) registerEncPubkey(acct account.Account) error {
+func (s *Service) registerEncPubkey(ctx context.Context, acct account.Account) error {
 	encrKey := getEncrKey(acct)
 	signature := hex.EncodeToString(acct.Sign(encrKey.PublicKeyBytes()))
 	body := toJSONRequestBody(map[string]interface{}{
 		"encryption_pubkey": fmt.Sprintf("%064x", encrKey.PublicKeyBytes()),
 		"signature":         signature,
 	})
-	req, _ := s.newAPIRequest("POST", fmt.Sprintf("/v1/encryption_keys/%s", acct.AccountNumber()), body)
+	req, _ := s.newAPIRequest(ctx, "POST", fmt.Sprintf("/v1/encryption_keys/%s", acct.AccountNumber()), body)
 
-	if _, err := s.submitRequest(req, nil); err != nil {
-		return fmt.Errorf("failed to register the encyrption public key for %s: %s", acct.AccountNumber(), err.Error())
+	start := time.Now()
+	_, err := s.submitRequest(req, nil)
+	observeUpstream("registerEncPubkey", start, err)
+	if err != nil {
+		return upstreamError(err, "failed to register the encyrption public key for %s", acct.AccountNumber())
 	}
 	return nil
 }
 
-func (s *Service) getEncPubkey(acctNo string) ([]byte, error) {
-	req, _ := s.newKeyRequest("GET", fmt.Sprintf("/%s", acctNo), nil)
+func (s *Service) getEncPubkey(ctx context.Context, acctNo string) ([]byte, error) {
+	req, _ := s.newKeyRequest(ctx, "GET", fmt.Sprintf("/%s", acctNo), nil)
 
 	var result struct {
 		Key string `json:"encryption_pubkey"`
 	}
-	if _, err := s.submitRequest(req, &result); err != nil {
-		return nil, fmt.Errorf("failed to get the encyrption public key for %s: %s", acctNo, err.Error())
+	start := time.Now()
+	_, err := s.submitRequest(req, &result)
+	observeUpstream("getEncPubkey", start, err)
+	if err != nil {
+		return nil, upstreamError(err, "failed to get the encyrption public key for %s", acctNo)
 	}
 
-	return hex.DecodeString(result.Key)
+	key, err := hex.DecodeString(result.Key)
+	if err != nil {
+		return nil, upstreamError(err, "invalid encyrption public key for %s", acctNo)
+	}
+	return key, nil
 }
 
 func toJSONRequestBody(data map[string]interface{}) io.Reader {
@@ -209,10 +247,14 @@ func toJSONRequestBody(data map[string]interface{}) io.Reader {
 }
 
 type ServiceError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	StatusCode int    `json:"-"`
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
 }
 
 func (se *ServiceError) Error() string {
+	if se.Code == 0 {
+		return se.Message
+	}
 	return fmt.Sprintf("[%d] %s", se.Code, se.Message)
 }
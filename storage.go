@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Storage persists the state of the service. The repositories operate on
+// the data of the active network, except for the account count which
+// covers every network served.
+type Storage interface {
+	Accounts() AccountRepository
+	Audit() AuditRepository
+	Grants() GrantRepository
+	Nonces() NonceRepository
+	AssetFiles() AssetFileRepository
+	Quotas() QuotaRepository
+
+	// Setup creates the schema of the active network and applies the
+	// pending migrations. With migrate unset it only checks that they
+	// have been applied.
+	Setup(migrate bool, report func(format string, args ...interface{})) error
+
+	// Check reports whether the storage is reachable
+	Check() error
+
+	// Lock runs fn while holding the named lock of the active network,
+	// which excludes the instances sharing the storage. The gate held
+	// by the context is suspended while waiting for the lock.
+	Lock(ctx context.Context, name string, fn func() error) error
+
+	Close() error
+}
+
+// AccountRepository stores the seeds of the custodial accounts
+type AccountRepository interface {
+	// Get returns the seed of the account, or nil if it isn't stored
+	Get(accountNo string) ([]byte, error)
+	Put(accountNo string, seed []byte) error
+	ForEach(fn func(accountNo string, seed []byte) error) error
+	Count() (int, error)
+}
+
+// AuditRepository stores the chained audit records
+type AuditRepository interface {
+	// Append links the record to the last one, assigns its sequence
+	// number and hash and stores it
+	Append(r *AuditRecord) error
+
+	// List returns the records after the given sequence number
+	List(after uint64, limit int, account, action string) ([]*AuditRecord, error)
+
+	// ForEach walks the stored records in sequence order
+	ForEach(fn func(seq uint64, data []byte) error) error
+}
+
+// GrantRepository stores the read access grants
+type GrantRepository interface {
+	Put(g *Grant) error
+
+	// Remove deletes the grant and returns it, or nil if it doesn't exist
+	Remove(bitmarkId, grantee string) (*Grant, error)
+	List(bitmarkId string) ([]*Grant, error)
+}
+
+// NonceRepository tracks the one-time download tokens used
+type NonceRepository interface {
+	// Redeem records the nonce until it expires and reports
+	// whether it had been redeemed before
+	Redeem(nonce string, expiry int64) (bool, error)
+}
+
+// AssetFileRepository stores the files the assets were issued from
+type AssetFileRepository interface {
+	Put(assetId string, f *assetFile) error
+
+	// Get returns the file of the asset, or nil if it isn't recorded
+	Get(assetId string) (*assetFile, error)
+}
+
+// QuotaRepository counts the daily usage of the quotas
+type QuotaRepository interface {
+	// Consume adds amount to the usage of each key on the given day,
+	// unless that would take any of them over the limit, and reports
+	// whether it did. The usage of the previous days is dropped.
+	Consume(day string, keys []string, amount, limit int64) (bool, error)
+
+	// Refund takes amount back from the usage of each key on the given
+	// day, for the operations which failed after consuming it
+	Refund(day string, keys []string, amount int64) error
+}
+
+const (
+	storageBolt     = "bolt"
+	storagePostgres = "postgres"
+)
+
+var storage Storage
+
+// openStorage opens the configured storage, bolt by default
+func openStorage(cfg *config) (Storage, error) {
+	switch cfg.Storage {
+	case "", storageBolt:
+		return openBoltStorage(fmt.Sprintf("%s/bitmark-trade.db", cfg.DataDir))
+	case storagePostgres:
+		return openSQLStorage(storagePostgres, cfg.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unknown storage: %q", cfg.Storage)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/boltdb/bolt"
+)
+
+// db is the bolt database, opened only with the bolt storage
+var db *bolt.DB
+
+// boltStorage keeps the data in the bolt database of the data directory,
+// with a set of buckets per network
+type boltStorage struct{}
+
+func openBoltStorage(dbpath string) (Storage, error) {
+	var err error
+	db, err = bolt.Open(dbpath, 0660, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return boltStorage{}, nil
+}
+
+func (boltStorage) Accounts() AccountRepository     { return boltAccounts{} }
+func (boltStorage) Audit() AuditRepository          { return boltAudit{} }
+func (boltStorage) Grants() GrantRepository         { return boltGrants{} }
+func (boltStorage) Nonces() NonceRepository         { return boltNonces{} }
+func (boltStorage) AssetFiles() AssetFileRepository { return boltAssetFiles{} }
+func (boltStorage) Quotas() QuotaRepository         { return boltQuotas{} }
+
+func (boltStorage) Setup(migrate bool, report func(format string, args ...interface{})) error {
+	if err := createBuckets(); err != nil {
+		return err
+	}
+
+	if !migrate {
+		return checkSchemaVersion()
+	}
+
+	version, err := migrateDB(false, report)
+	if err != nil {
+		return err
+	}
+	report("%s database schema version %d", bmksdk.GetNetwork(), version)
+	return nil
+}
+
+func (boltStorage) Check() error {
+	return viewDB(func(tx *bolt.Tx) error {
+		for name := range networks {
+			if tx.Bucket(accountBucketName(name)) == nil {
+				return fmt.Errorf("account bucket of %s not found", name)
+			}
+		}
+		return nil
+	})
+}
+
+// boltLock serializes the locked sections, since a bolt database is
+// opened by a single process
+var boltLock sync.Mutex
+
+// Lock lets the other networks in while it waits for the lock
+func (boltStorage) Lock(ctx context.Context, name string, fn func() error) error {
+	resume := gate.suspend(gateHoldOf(ctx))
+	boltLock.Lock()
+	resume()
+	defer boltLock.Unlock()
+
+	return fn()
+}
+
+func (boltStorage) Close() error {
+	return db.Close()
+}
+
+// createBuckets creates the buckets of the active network
+func createBuckets() error {
+	return updateDB(func(tx *bolt.Tx) error {
+		buckets := [][]byte{
+			getAccountBucketName(),
+			getAuditBucketName(),
+			getGrantBucketName(),
+			getDownloadTokenBucketName(),
+			getAssetFileBucketName(),
+			getQuotaBucketName(),
+			getMetaBucketName(),
+		}
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+type boltAccounts struct{}
+
+func (boltAccounts) Get(accountNo string) ([]byte, error) {
+	var val []byte
+	err := viewDB(func(tx *bolt.Tx) error {
+		// the value is only valid within the transaction
+		if v := tx.Bucket(getAccountBucketName()).Get([]byte(accountNo)); v != nil {
+			val = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return val, err
+}
+
+func (boltAccounts) Put(accountNo string, seed []byte) error {
+	return updateDB(func(tx *bolt.Tx) error {
+		return tx.Bucket(getAccountBucketName()).Put([]byte(accountNo), seed)
+	})
+}
+
+func (boltAccounts) ForEach(fn func(accountNo string, seed []byte) error) error {
+	return viewDB(func(tx *bolt.Tx) error {
+		return tx.Bucket(getAccountBucketName()).ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (boltAccounts) Count() (int, error) {
+	var n int
+	err := viewDB(func(tx *bolt.Tx) error {
+		for name := range networks {
+			if b := tx.Bucket(accountBucketName(name)); b != nil {
+				n += b.Stats().KeyN
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+type boltAudit struct{}
+
+func auditKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func (boltAudit) Append(r *AuditRecord) error {
+	return updateDB(func(tx *bolt.Tx) error {
+		b := tx.Bucket(getAuditBucketName())
+
+		if _, last := b.Cursor().Last(); last != nil {
+			var prev AuditRecord
+			if err := json.Unmarshal(last, &prev); err != nil {
+				return err
+			}
+			r.PrevHash = prev.Hash
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		r.Sequence = seq
+
+		if r.Hash, err = r.computeHash(); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(auditKey(seq), data)
+	})
+}
+
+func (boltAudit) List(after uint64, limit int, account, action string) ([]*AuditRecord, error) {
+	records := make([]*AuditRecord, 0)
+
+	err := viewDB(func(tx *bolt.Tx) error {
+		c := tx.Bucket(getAuditBucketName()).Cursor()
+		for k, v := c.Seek(auditKey(after + 1)); k != nil && len(records) < limit; k, v = c.Next() {
+			var r AuditRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if account != "" && r.Account != account {
+				continue
+			}
+			if action != "" && r.Action != action {
+				continue
+			}
+			records = append(records, &r)
+		}
+		return nil
+	})
+
+	return records, err
+}
+
+func (boltAudit) ForEach(fn func(seq uint64, data []byte) error) error {
+	return viewDB(func(tx *bolt.Tx) error {
+		c := tx.Bucket(getAuditBucketName()).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := fn(binary.BigEndian.Uint64(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type boltGrants struct{}
+
+func grantKey(bitmarkId, grantee string) []byte {
+	return []byte(bitmarkId + "|" + grantee)
+}
+
+func (boltGrants) Put(g *Grant) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	return updateDB(func(tx *bolt.Tx) error {
+		return tx.Bucket(getGrantBucketName()).Put(grantKey(g.BitmarkId, g.Grantee), data)
+	})
+}
+
+func (boltGrants) Remove(bitmarkId, grantee string) (*Grant, error) {
+	var g *Grant
+
+	err := updateDB(func(tx *bolt.Tx) error {
+		b := tx.Bucket(getGrantBucketName())
+		key := grantKey(bitmarkId, grantee)
+		if v := b.Get(key); v != nil {
+			g = new(Grant)
+			if err := json.Unmarshal(v, g); err != nil {
+				return err
+			}
+		}
+		return b.Delete(key)
+	})
+
+	return g, err
+}
+
+func (boltGrants) List(bitmarkId string) ([]*Grant, error) {
+	grants := make([]*Grant, 0)
+
+	err := viewDB(func(tx *bolt.Tx) error {
+		prefix := []byte(bitmarkId + "|")
+		c := tx.Bucket(getGrantBucketName()).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var g Grant
+			if err := json.Unmarshal(v, &g); err != nil {
+				return err
+			}
+			grants = append(grants, &g)
+		}
+		return nil
+	})
+
+	return grants, err
+}
+
+type boltNonces struct{}
+
+// Redeem prunes the expired nonces on the way
+func (boltNonces) Redeem(nonce string, expiry int64) (bool, error) {
+	used := false
+
+	err := updateDB(func(tx *bolt.Tx) error {
+		b := tx.Bucket(getDownloadTokenBucketName())
+
+		if b.Get([]byte(nonce)) != nil {
+			used = true
+			return nil
+		}
+
+		// a cursor skips the key following the one deleted,
+		// so the expired nonces are deleted once found
+		var expired [][]byte
+		now := time.Now().Unix()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if int64(binary.BigEndian.Uint64(v)) < now {
+				expired = append(expired, append([]byte{}, k...))
+			}
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(expiry))
+		return b.Put([]byte(nonce), v)
+	})
+
+	return used, err
+}
+
+type boltAssetFiles struct{}
+
+func (boltAssetFiles) Put(assetId string, f *assetFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return updateDB(func(tx *bolt.Tx) error {
+		return tx.Bucket(getAssetFileBucketName()).Put([]byte(assetId), data)
+	})
+}
+
+func (boltAssetFiles) Get(assetId string) (*assetFile, error) {
+	var f *assetFile
+
+	err := viewDB(func(tx *bolt.Tx) error {
+		v := tx.Bucket(getAssetFileBucketName()).Get([]byte(assetId))
+		if v == nil {
+			return nil
+		}
+		f = new(assetFile)
+		return json.Unmarshal(v, f)
+	})
+
+	return f, err
+}
+
+type boltQuotas struct{}
+
+func getQuotaBucketName() []byte {
+	return []byte(fmt.Sprintf("quota-%s", string(bmksdk.GetNetwork())))
+}
+
+// Consume keys the usage by day, so that the days before
+// sort first and are pruned on the way
+func (boltQuotas) Consume(day string, keys []string, amount, limit int64) (bool, error) {
+	ok := true
+
+	err := updateDB(func(tx *bolt.Tx) error {
+		b := tx.Bucket(getQuotaBucketName())
+
+		// collected first, as for the nonces
+		var previous [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < day; k, _ = c.Next() {
+			previous = append(previous, append([]byte{}, k...))
+		}
+		for _, k := range previous {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		used := make([]int64, len(keys))
+		for i, key := range keys {
+			if v := b.Get([]byte(day + "|" + key)); len(v) == 8 {
+				used[i] = int64(binary.BigEndian.Uint64(v))
+			}
+			if used[i]+amount > limit {
+				ok = false
+				return nil
+			}
+		}
+
+		for i, key := range keys {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(used[i]+amount))
+			if err := b.Put([]byte(day+"|"+key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return ok, err
+}
+
+func (boltQuotas) Refund(day string, keys []string, amount int64) error {
+	return updateDB(func(tx *bolt.Tx) error {
+		b := tx.Bucket(getQuotaBucketName())
+
+		for _, key := range keys {
+			k := []byte(day + "|" + key)
+			v := b.Get(k)
+			if len(v) != 8 {
+				continue
+			}
+
+			used := int64(binary.BigEndian.Uint64(v)) - amount
+			if used <= 0 {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+
+			v = make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(used))
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	_ "github.com/lib/pq"
+)
+
+// sqlSchema holds the data of every network, so that several instances
+// may share the database whatever the networks they serve
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS accounts (
+		network    TEXT NOT NULL,
+		account_no TEXT NOT NULL,
+		seed       TEXT NOT NULL,
+		PRIMARY KEY (network, account_no)
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_records (
+		network  TEXT NOT NULL,
+		sequence BIGINT NOT NULL,
+		data     TEXT NOT NULL,
+		PRIMARY KEY (network, sequence)
+	)`,
+	`CREATE TABLE IF NOT EXISTS grants (
+		network    TEXT NOT NULL,
+		bitmark_id TEXT NOT NULL,
+		grantee    TEXT NOT NULL,
+		data       TEXT NOT NULL,
+		PRIMARY KEY (network, bitmark_id, grantee)
+	)`,
+	`CREATE TABLE IF NOT EXISTS download_nonces (
+		network    TEXT NOT NULL,
+		nonce      TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (network, nonce)
+	)`,
+	`CREATE TABLE IF NOT EXISTS quota_usage (
+		network TEXT NOT NULL,
+		day     TEXT NOT NULL,
+		key     TEXT NOT NULL,
+		used    BIGINT NOT NULL,
+		PRIMARY KEY (network, day, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS asset_files (
+		network  TEXT NOT NULL,
+		asset_id TEXT NOT NULL,
+		data     TEXT NOT NULL,
+		PRIMARY KEY (network, asset_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS locks (
+		network    TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		holder     TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (network, name)
+	)`,
+}
+
+// sqlTables are the tables created by sqlSchema
+var sqlTables = []string{"accounts", "audit_records", "grants", "download_nonces", "quota_usage", "asset_files", "locks"}
+
+// sqlLockLease is how long a lock is held by a replica which stopped
+// without releasing it. The holder renews the lease until it is done.
+// The leases expire at the time in nanoseconds.
+var sqlLockLease = time.Minute
+
+// sqlLockPoll is how often a lock held by another replica is retried
+var sqlLockPoll = 200 * time.Millisecond
+
+// sqlDialect is what differs between the databases of the SQL storage.
+// The statements are written for PostgreSQL; SQLite runs the tests
+// against an embedded database, with its driver linked in by them.
+type sqlDialect struct {
+	// dsn adds the options the storage relies on to the url
+	dsn func(url string) string
+
+	// rebind rewrites the $n parameters of the statement
+	rebind func(query string) string
+
+	// tableExists queries whether the table named $1 exists
+	tableExists string
+
+	// lockAudit locks the audit records against concurrent appends,
+	// unless the transactions are serialized anyway
+	lockAudit string
+}
+
+const sqlDriverSQLite = "sqlite3"
+
+var sqliteParameter = regexp.MustCompile(`\$(\d+)`)
+
+var sqlDialects = map[string]*sqlDialect{
+	storagePostgres: {
+		dsn:         func(url string) string { return url },
+		rebind:      func(query string) string { return query },
+		tableExists: `SELECT to_regclass($1) IS NOT NULL`,
+		lockAudit:   `LOCK TABLE audit_records IN SHARE ROW EXCLUSIVE MODE`,
+	},
+
+	// the transactions take the write lock of the database as they
+	// begin, and wait for it instead of failing while it is busy
+	sqlDriverSQLite: {
+		dsn: func(url string) string {
+			separator := "?"
+			if strings.Contains(url, "?") {
+				separator = "&"
+			}
+			return url + separator + "_txlock=immediate&_busy_timeout=10000"
+		},
+		rebind: func(query string) string {
+			return sqliteParameter.ReplaceAllString(query, "?$1")
+		},
+		tableExists: `SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = $1`,
+	},
+}
+
+// sqlStorage keeps the data in a PostgreSQL database, which lets
+// several replicas of the service share their state
+type sqlStorage struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func openSQLStorage(driver, url string) (Storage, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database: %q", driver)
+	}
+
+	db, err := sql.Open(driver, dialect.dsn(url))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStorage{db, dialect}, nil
+}
+
+// sqlConn runs the statements in the dialect of the database
+type sqlConn struct {
+	q interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+		Query(query string, args ...interface{}) (*sql.Rows, error)
+		QueryRow(query string, args ...interface{}) *sql.Row
+	}
+	dialect *sqlDialect
+}
+
+func (c sqlConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.q.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c sqlConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.Query(c.dialect.rebind(query), args...)
+}
+
+func (c sqlConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRow(c.dialect.rebind(query), args...)
+}
+
+func (s *sqlStorage) Accounts() AccountRepository     { return sqlAccounts{s} }
+func (s *sqlStorage) Audit() AuditRepository          { return sqlAudit{s} }
+func (s *sqlStorage) Grants() GrantRepository         { return sqlGrants{s} }
+func (s *sqlStorage) Nonces() NonceRepository         { return sqlNonces{s} }
+func (s *sqlStorage) AssetFiles() AssetFileRepository { return sqlAssetFiles{s} }
+func (s *sqlStorage) Quotas() QuotaRepository         { return sqlQuotas{s} }
+
+// Setup creates the tables, which hold every network at once. With
+// migrate unset it only checks that they exist. The bolt migrations
+// convert data written by earlier versions, so there is nothing to
+// migrate in a SQL database yet.
+func (s *sqlStorage) Setup(migrate bool, report func(format string, args ...interface{})) error {
+	if !migrate {
+		return s.checkTables()
+	}
+
+	return s.update(func(tx sqlConn) error {
+		for _, stmt := range sqlSchema {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStorage) checkTables() error {
+	for _, table := range sqlTables {
+		var exists bool
+		if err := s.conn().QueryRow(s.dialect.tableExists, table).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("table %s not found, start the service first to create the schema", table)
+		}
+	}
+	return nil
+}
+
+func (s *sqlStorage) Check() error {
+	return s.db.Ping()
+}
+
+// Lock holds the lease of the lock row of the name while fn runs. No
+// transaction or connection is held meanwhile, since fn calls the
+// upstream. The lease is renewed until fn returns, and expires if the
+// replica holding it stops. The other networks are let in while it
+// waits for the lock.
+func (s *sqlStorage) Lock(ctx context.Context, name string, fn func() error) error {
+	network := activeNetwork()
+	holder, err := newLockHolder()
+	if err != nil {
+		return err
+	}
+
+	resume := gate.suspend(gateHoldOf(ctx))
+	err = s.acquire(ctx, network, name, holder)
+	resume()
+	if err != nil {
+		return err
+	}
+	defer s.release(network, name, holder)
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.renew(network, name, holder, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	return fn()
+}
+
+func newLockHolder() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// acquire takes the lock unless another holder's lease is running,
+// and retries until it is released or expires
+func (s *sqlStorage) acquire(ctx context.Context, network, name, holder string) error {
+	for {
+		acquired := false
+		err := s.update(func(tx sqlConn) error {
+			now := time.Now()
+			result, err := tx.Exec(`INSERT INTO locks (network, name, holder, expires_at) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (network, name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+				WHERE locks.expires_at < $5`,
+				network, name, holder, now.Add(sqlLockLease).UnixNano(), now.UnixNano())
+			if err != nil {
+				return err
+			}
+
+			n, err := result.RowsAffected()
+			acquired = n == 1
+			return err
+		})
+		if err != nil || acquired {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sqlLockPoll):
+		}
+	}
+}
+
+func (s *sqlStorage) renew(network, name, holder string, stop <-chan struct{}) {
+	ticker := time.NewTicker(sqlLockLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := s.update(func(tx sqlConn) error {
+			_, err := tx.Exec(`UPDATE locks SET expires_at = $4 WHERE network = $1 AND name = $2 AND holder = $3`,
+				network, name, holder, time.Now().Add(sqlLockLease).UnixNano())
+			return err
+		})
+		if err != nil {
+			log.Warnf("failed to renew the lock %s of %s: %s", name, network, err)
+		}
+	}
+}
+
+func (s *sqlStorage) release(network, name, holder string) {
+	err := s.update(func(tx sqlConn) error {
+		_, err := tx.Exec(`DELETE FROM locks WHERE network = $1 AND name = $2 AND holder = $3`,
+			network, name, holder)
+		return err
+	})
+	if err != nil {
+		log.Warnf("failed to release the lock %s of %s: %s", name, network, err)
+	}
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStorage) conn() sqlConn {
+	return sqlConn{s.db, s.dialect}
+}
+
+// view runs the read-only statements of fn and records their duration
+func (s *sqlStorage) view(fn func(db sqlConn) error) error {
+	defer dbDuration.ObserveSince(time.Now(), "view")
+	return fn(s.conn())
+}
+
+// update runs fn in a transaction, which is committed if fn succeeds,
+// and records its duration
+func (s *sqlStorage) update(fn func(tx sqlConn) error) error {
+	defer dbDuration.ObserveSince(time.Now(), "update")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(sqlConn{tx, s.dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func activeNetwork() string {
+	return string(bmksdk.GetNetwork())
+}
+
+type sqlAccounts struct{ *sqlStorage }
+
+func (s sqlAccounts) Get(accountNo string) ([]byte, error) {
+	var seed string
+	err := s.view(func(db sqlConn) error {
+		return db.QueryRow(`SELECT seed FROM accounts WHERE network = $1 AND account_no = $2`,
+			activeNetwork(), accountNo).Scan(&seed)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(seed), nil
+}
+
+func (s sqlAccounts) Put(accountNo string, seed []byte) error {
+	return s.update(func(tx sqlConn) error {
+		_, err := tx.Exec(`INSERT INTO accounts (network, account_no, seed) VALUES ($1, $2, $3)
+			ON CONFLICT (network, account_no) DO UPDATE SET seed = excluded.seed`,
+			activeNetwork(), accountNo, string(seed))
+		return err
+	})
+}
+
+func (s sqlAccounts) ForEach(fn func(accountNo string, seed []byte) error) error {
+	return s.view(func(db sqlConn) error {
+		rows, err := db.Query(`SELECT account_no, seed FROM accounts WHERE network = $1 ORDER BY account_no`,
+			activeNetwork())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var accountNo, seed string
+			if err := rows.Scan(&accountNo, &seed); err != nil {
+				return err
+			}
+			if err := fn(accountNo, []byte(seed)); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// Count only covers the networks served by this instance
+func (s sqlAccounts) Count() (int, error) {
+	var total int
+	err := s.view(func(db sqlConn) error {
+		for name := range networks {
+			var n int
+			if err := db.QueryRow(`SELECT count(*) FROM accounts WHERE network = $1`,
+				string(name)).Scan(&n); err != nil {
+				return err
+			}
+			total += n
+		}
+		return nil
+	})
+	return total, err
+}
+
+type sqlAudit struct{ *sqlStorage }
+
+// Append locks the table against concurrent appends, so that the
+// replicas sharing the database keep a single chain per network
+func (s sqlAudit) Append(r *AuditRecord) error {
+	return s.update(func(tx sqlConn) error {
+		if s.dialect.lockAudit != "" {
+			if _, err := tx.Exec(s.dialect.lockAudit); err != nil {
+				return err
+			}
+		}
+
+		var last string
+		err := tx.QueryRow(`SELECT data FROM audit_records WHERE network = $1 ORDER BY sequence DESC LIMIT 1`,
+			activeNetwork()).Scan(&last)
+		switch err {
+		case nil:
+			var prev AuditRecord
+			if err := json.Unmarshal([]byte(last), &prev); err != nil {
+				return err
+			}
+			r.PrevHash = prev.Hash
+			r.Sequence = prev.Sequence + 1
+		case sql.ErrNoRows:
+			r.Sequence = 1
+		default:
+			return err
+		}
+
+		if r.Hash, err = r.computeHash(); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO audit_records (network, sequence, data) VALUES ($1, $2, $3)`,
+			activeNetwork(), int64(r.Sequence), string(data))
+		return err
+	})
+}
+
+func (s sqlAudit) List(after uint64, limit int, account, action string) ([]*AuditRecord, error) {
+	records := make([]*AuditRecord, 0)
+
+	err := s.view(func(db sqlConn) error {
+		rows, err := db.Query(`SELECT data FROM audit_records WHERE network = $1 AND sequence > $2 ORDER BY sequence`,
+			activeNetwork(), int64(after))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() && len(records) < limit {
+			var data string
+			if err := rows.Scan(&data); err != nil {
+				return err
+			}
+
+			var r AuditRecord
+			if err := json.Unmarshal([]byte(data), &r); err != nil {
+				return err
+			}
+			if account != "" && r.Account != account {
+				continue
+			}
+			if action != "" && r.Action != action {
+				continue
+			}
+			records = append(records, &r)
+		}
+		return rows.Err()
+	})
+
+	return records, err
+}
+
+func (s sqlAudit) ForEach(fn func(seq uint64, data []byte) error) error {
+	return s.view(func(db sqlConn) error {
+		rows, err := db.Query(`SELECT sequence, data FROM audit_records WHERE network = $1 ORDER BY sequence`,
+			activeNetwork())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				seq  int64
+				data string
+			)
+			if err := rows.Scan(&seq, &data); err != nil {
+				return err
+			}
+			if err := fn(uint64(seq), []byte(data)); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+type sqlGrants struct{ *sqlStorage }
+
+func (s sqlGrants) Put(g *Grant) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(tx sqlConn) error {
+		_, err := tx.Exec(`INSERT INTO grants (network, bitmark_id, grantee, data) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (network, bitmark_id, grantee) DO UPDATE SET data = excluded.data`,
+			activeNetwork(), g.BitmarkId, g.Grantee, string(data))
+		return err
+	})
+}
+
+func (s sqlGrants) Remove(bitmarkId, grantee string) (*Grant, error) {
+	var g *Grant
+
+	err := s.update(func(tx sqlConn) error {
+		var data string
+		err := tx.QueryRow(`DELETE FROM grants WHERE network = $1 AND bitmark_id = $2 AND grantee = $3 RETURNING data`,
+			activeNetwork(), bitmarkId, grantee).Scan(&data)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		g = new(Grant)
+		return json.Unmarshal([]byte(data), g)
+	})
+
+	return g, err
+}
+
+func (s sqlGrants) List(bitmarkId string) ([]*Grant, error) {
+	grants := make([]*Grant, 0)
+
+	err := s.view(func(db sqlConn) error {
+		rows, err := db.Query(`SELECT data FROM grants WHERE network = $1 AND bitmark_id = $2 ORDER BY grantee`,
+			activeNetwork(), bitmarkId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var data string
+			if err := rows.Scan(&data); err != nil {
+				return err
+			}
+
+			var g Grant
+			if err := json.Unmarshal([]byte(data), &g); err != nil {
+				return err
+			}
+			grants = append(grants, &g)
+		}
+		return rows.Err()
+	})
+
+	return grants, err
+}
+
+type sqlNonces struct{ *sqlStorage }
+
+// Redeem prunes the expired nonces on the way. The primary key makes
+// the insert fail for a nonce redeemed by another replica meanwhile.
+func (s sqlNonces) Redeem(nonce string, expiry int64) (bool, error) {
+	used := false
+
+	err := s.update(func(tx sqlConn) error {
+		if _, err := tx.Exec(`DELETE FROM download_nonces WHERE network = $1 AND expires_at < $2`,
+			activeNetwork(), time.Now().Unix()); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`INSERT INTO download_nonces (network, nonce, expires_at) VALUES ($1, $2, $3)
+			ON CONFLICT (network, nonce) DO NOTHING`,
+			activeNetwork(), nonce, expiry)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		used = n == 0
+		return nil
+	})
+
+	return used, err
+}
+
+type sqlAssetFiles struct{ *sqlStorage }
+
+func (s sqlAssetFiles) Put(assetId string, f *assetFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(tx sqlConn) error {
+		_, err := tx.Exec(`INSERT INTO asset_files (network, asset_id, data) VALUES ($1, $2, $3)
+			ON CONFLICT (network, asset_id) DO UPDATE SET data = excluded.data`,
+			activeNetwork(), assetId, string(data))
+		return err
+	})
+}
+
+func (s sqlAssetFiles) Get(assetId string) (*assetFile, error) {
+	var data string
+	err := s.view(func(db sqlConn) error {
+		return db.QueryRow(`SELECT data FROM asset_files WHERE network = $1 AND asset_id = $2`,
+			activeNetwork(), assetId).Scan(&data)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := new(assetFile)
+	if err := json.Unmarshal([]byte(data), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type sqlQuotas struct{ *sqlStorage }
+
+// errQuotaExceeded rolls back the usage counted for the other keys
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Consume relies on the row locks taken by the upserts, so that the
+// replicas don't exceed the quota together
+func (s sqlQuotas) Consume(day string, keys []string, amount, limit int64) (bool, error) {
+	if amount > limit {
+		return false, nil
+	}
+
+	err := s.update(func(tx sqlConn) error {
+		if _, err := tx.Exec(`DELETE FROM quota_usage WHERE network = $1 AND day < $2`,
+			activeNetwork(), day); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			var used int64
+			err := tx.QueryRow(`INSERT INTO quota_usage (network, day, key, used) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (network, day, key) DO UPDATE SET used = quota_usage.used + excluded.used
+				WHERE quota_usage.used + excluded.used <= $5
+				RETURNING used`,
+				activeNetwork(), day, key, amount, limit).Scan(&used)
+			if err == sql.ErrNoRows {
+				return errQuotaExceeded
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err == errQuotaExceeded {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s sqlQuotas) Refund(day string, keys []string, amount int64) error {
+	return s.update(func(tx sqlConn) error {
+		for _, key := range keys {
+			if _, err := tx.Exec(`UPDATE quota_usage SET used = CASE WHEN used > $4 THEN used - $4 ELSE 0 END
+				WHERE network = $1 AND day = $2 AND key = $3`,
+				activeNetwork(), day, key, amount); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
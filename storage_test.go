@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestSQLStorage sets up the SQL storage as the storage of the
+// service. The database must be a scratch one, since the data of the
+// active network is deleted before and after the test.
+func openTestSQLStorage(t *testing.T, driver, url string) func() {
+	s, err := openSQLStorage(driver, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Setup(true, t.Logf); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	clear := func() {
+		for _, table := range sqlTables {
+			if _, err := s.(*sqlStorage).conn().Exec(`DELETE FROM `+table+` WHERE network = $1`, activeNetwork()); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	clear()
+
+	storage = s
+	return func() {
+		clear()
+		s.Close()
+	}
+}
+
+// openTestSQLiteStorage sets up the SQL storage in a scratch SQLite database
+func openTestSQLiteStorage(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "bitmark-trade-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStorage := openTestSQLStorage(t, sqlDriverSQLite, "file:"+filepath.Join(dir, "trade.db"))
+	return func() {
+		closeStorage()
+		os.RemoveAll(dir)
+	}
+}
+
+// testEachStorage runs the test against each storage. The SQL storage
+// runs on SQLite, and on PostgreSQL as well when DATABASE_URL is set.
+func testEachStorage(t *testing.T, test func(t *testing.T, s Storage)) {
+	t.Run(storageBolt, func(t *testing.T) {
+		defer openTestBoltStorage(t)()
+		test(t, storage)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		defer openTestSQLiteStorage(t)()
+		test(t, storage)
+	})
+
+	t.Run(storagePostgres, func(t *testing.T) {
+		url := os.Getenv("DATABASE_URL")
+		if url == "" {
+			t.Skip("DATABASE_URL is not set")
+		}
+		defer openTestSQLStorage(t, storagePostgres, url)()
+		test(t, storage)
+	})
+}
+
+// testEachSQLStorage runs the test against the SQL storage only
+func testEachSQLStorage(t *testing.T, test func(t *testing.T, s *sqlStorage)) {
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		if sqlStore, ok := s.(*sqlStorage); ok {
+			test(t, sqlStore)
+		}
+	})
+}
+
+func TestAuditAppendChaining(t *testing.T) {
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		for _, action := range []string{"register", "issue", "transfer"} {
+			if err := s.Audit().Append(&AuditRecord{Action: action, Status: "ok"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		records, err := s.Audit().List(0, 10, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !assert.Len(t, records, 3) {
+			return
+		}
+
+		prevHash := ""
+		for i, r := range records {
+			assert.Equal(t, uint64(i+1), r.Sequence)
+			assert.Equal(t, prevHash, r.PrevHash)
+
+			hash, err := r.computeHash()
+			assert.NoError(t, err)
+			assert.Equal(t, hash, r.Hash)
+			prevHash = r.Hash
+		}
+
+		records, err = s.Audit().List(1, 10, "", "transfer")
+		assert.NoError(t, err)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, uint64(3), records[0].Sequence)
+		}
+	})
+}
+
+func TestQuotasConsumeAtTheLimit(t *testing.T) {
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		q := s.Quotas()
+
+		ok, err := q.Consume("2026-10-19", []string{"a", "b"}, 3, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		// up to the limit
+		ok, err = q.Consume("2026-10-19", []string{"a", "b"}, 2, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = q.Consume("2026-10-19", []string{"a"}, 1, 5)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		// nothing is counted for c when a is over the limit
+		ok, err = q.Consume("2026-10-19", []string{"c", "a"}, 1, 5)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = q.Consume("2026-10-19", []string{"c"}, 5, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = q.Consume("2026-10-20", []string{"a"}, 6, 5)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		// the usage starts over the next day
+		ok, err = q.Consume("2026-10-20", []string{"a", "b"}, 5, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
+
+func TestQuotasRefund(t *testing.T) {
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		q := s.Quotas()
+
+		ok, err := q.Consume("2026-10-19", []string{"a", "b"}, 5, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		assert.NoError(t, q.Refund("2026-10-19", []string{"a", "b"}, 3))
+		ok, err = q.Consume("2026-10-19", []string{"a", "b"}, 3, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		// the usage doesn't go below zero, nor is another day refunded
+		assert.NoError(t, q.Refund("2026-10-19", []string{"a", "c"}, 10))
+		assert.NoError(t, q.Refund("2026-10-18", []string{"b"}, 5))
+		ok, err = q.Consume("2026-10-19", []string{"a", "c"}, 5, 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = q.Consume("2026-10-19", []string{"b"}, 1, 5)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
+
+func TestNoncesRedeemTwice(t *testing.T) {
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		n := s.Nonces()
+		expiry := time.Now().Add(time.Hour).Unix()
+
+		used, err := n.Redeem("nonce", expiry)
+		assert.NoError(t, err)
+		assert.False(t, used)
+
+		used, err = n.Redeem("nonce", expiry)
+		assert.NoError(t, err)
+		assert.True(t, used)
+
+		// the expired nonces are forgotten
+		used, err = n.Redeem("expired", time.Now().Add(-time.Hour).Unix())
+		assert.NoError(t, err)
+		assert.False(t, used)
+
+		used, err = n.Redeem("other", expiry)
+		assert.NoError(t, err)
+		assert.False(t, used)
+
+		used, err = n.Redeem("expired", expiry)
+		assert.NoError(t, err)
+		assert.False(t, used)
+	})
+}
+
+func TestGrantsRemove(t *testing.T) {
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		g, err := s.Grants().Remove("bitmark", "grantee")
+		assert.NoError(t, err)
+		assert.Nil(t, g)
+
+		grant := &Grant{
+			BitmarkId: "bitmark",
+			AssetId:   "asset",
+			Owner:     "owner",
+			Grantee:   "grantee",
+			CreatedAt: time.Unix(1760000000, 0).UTC(),
+		}
+		if err := s.Grants().Put(grant); err != nil {
+			t.Fatal(err)
+		}
+
+		grants, err := s.Grants().List("bitmark")
+		assert.NoError(t, err)
+		assert.Equal(t, []*Grant{grant}, grants)
+
+		g, err = s.Grants().Remove("bitmark", "grantee")
+		assert.NoError(t, err)
+		assert.Equal(t, grant, g)
+
+		grants, err = s.Grants().List("bitmark")
+		assert.NoError(t, err)
+		assert.Empty(t, grants)
+	})
+}
+
+func TestStorageLockSerializes(t *testing.T) {
+	defer func(poll time.Duration) { sqlLockPoll = poll }(sqlLockPoll)
+	sqlLockPoll = 10 * time.Millisecond
+
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		var (
+			mu      sync.Mutex
+			inside  int
+			overlap bool
+			wg      sync.WaitGroup
+		)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.Lock(context.Background(), "rekey", func() error {
+					mu.Lock()
+					inside++
+					overlap = overlap || inside > 1
+					mu.Unlock()
+
+					time.Sleep(20 * time.Millisecond)
+
+					mu.Lock()
+					inside--
+					mu.Unlock()
+					return nil
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		assert.False(t, overlap)
+	})
+}
+
+func TestStorageLockLetsTheOtherNetworksInWhileWaiting(t *testing.T) {
+	defer func(poll time.Duration) { sqlLockPoll = poll }(sqlLockPoll)
+	sqlLockPoll = 10 * time.Millisecond
+
+	testEachStorage(t, func(t *testing.T, s Storage) {
+		test, _ := testNetworks(t)
+		defer defaultNetwork.activate()
+
+		held, release := make(chan struct{}), make(chan struct{})
+		go s.Lock(context.Background(), "rekey", func() error {
+			close(held)
+			<-release
+			return nil
+		})
+		<-held
+
+		h := gate.enter(test)
+		done := make(chan error)
+		go func() {
+			done <- s.Lock(withGateHold(context.Background(), h), "rekey", func() error { return nil })
+		}()
+
+		// the request waiting for the lock doesn't hold the gate
+		time.Sleep(50 * time.Millisecond)
+		gate.Lock()
+		assert.Equal(t, 0, gate.running)
+		gate.Unlock()
+
+		close(release)
+		assert.NoError(t, <-done)
+		gate.Lock()
+		assert.Equal(t, 1, gate.running)
+		gate.Unlock()
+		gate.leave(h)
+	})
+}
+
+func TestSQLLockLease(t *testing.T) {
+	defer func(lease, poll time.Duration) { sqlLockLease, sqlLockPoll = lease, poll }(sqlLockLease, sqlLockPoll)
+	sqlLockLease, sqlLockPoll = 150*time.Millisecond, 10*time.Millisecond
+
+	testEachSQLStorage(t, func(t *testing.T, s *sqlStorage) {
+		hold := func(holder string, expiresAt time.Time) {
+			_, err := s.conn().Exec(`INSERT INTO locks (network, name, holder, expires_at) VALUES ($1, $2, $3, $4)`,
+				activeNetwork(), "rekey", holder, expiresAt.UnixNano())
+			assert.NoError(t, err)
+		}
+		holders := func() int {
+			var n int
+			assert.NoError(t, s.conn().QueryRow(`SELECT count(*) FROM locks WHERE network = $1`, activeNetwork()).Scan(&n))
+			return n
+		}
+		lockWithin := func(timeout time.Duration) (bool, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			ran := false
+			err := s.Lock(ctx, "rekey", func() error {
+				ran = true
+				return nil
+			})
+			return ran, err
+		}
+
+		// the lock of another replica is waited for
+		hold("other", time.Now().Add(time.Hour))
+		ran, err := lockWithin(50 * time.Millisecond)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.False(t, ran)
+
+		// and taken over once its lease expires
+		_, err = s.conn().Exec(`UPDATE locks SET expires_at = $2 WHERE network = $1`,
+			activeNetwork(), time.Now().Add(-time.Second).UnixNano())
+		assert.NoError(t, err)
+		ran, err = lockWithin(50 * time.Millisecond)
+		assert.NoError(t, err)
+		assert.True(t, ran)
+		assert.Equal(t, 0, holders())
+
+		// the lease is renewed while the holder runs
+		held, release := make(chan struct{}), make(chan struct{})
+		go s.Lock(context.Background(), "rekey", func() error {
+			close(held)
+			<-release
+			return nil
+		})
+		<-held
+		ran, err = lockWithin(3 * sqlLockLease)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.False(t, ran)
+
+		// no connection is held meanwhile, except by the renewals
+		idle := false
+		for i := 0; i < 10 && !idle; i++ {
+			idle = s.db.Stats().InUse == 0
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.True(t, idle)
+
+		close(release)
+		ran, err = lockWithin(time.Second)
+		assert.NoError(t, err)
+		assert.True(t, ran)
+	})
+}
+
+func TestBoltQuotasPrunePreviousDays(t *testing.T) {
+	defer openTestBoltStorage(t)()
+
+	q := storage.Quotas()
+	ok, err := q.Consume("2026-10-18", []string{"a", "b", "c", "d"}, 1, 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = q.Consume("2026-10-19", []string{"a"}, 1, 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	var keys []string
+	assert.NoError(t, viewDB(func(tx *bolt.Tx) error {
+		return tx.Bucket(getQuotaBucketName()).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}))
+	assert.Equal(t, []string{"2026-10-19|a"}, keys)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// upstream requests turned down with 429 are retried this many times
+	maxUpstreamRetries = 5
+
+	// waits asked by Retry-After are capped, and a second is waited
+	// when the upstream doesn't say
+	maxUpstreamRetryAfter     = time.Minute
+	defaultUpstreamRetryAfter = time.Second
+)
+
+// throttle paces the requests sent with the API token of a network. The
+// requests beyond the rate or the concurrency cap queue up instead of
+// failing, and a 429 response holds back every request until the time
+// the upstream asks for.
+type throttle struct {
+	sync.Mutex
+	network string
+	limiter *rateLimiter
+	slots   chan struct{}
+	paused  time.Time
+}
+
+func newThrottle(network string, rate float64, burst, concurrency int) *throttle {
+	t := &throttle{network: network}
+	if rate > 0 {
+		t.limiter = newRateLimiter(rate, burst)
+	}
+	if concurrency > 0 {
+		t.slots = make(chan struct{}, concurrency)
+	}
+	return t
+}
+
+// acquire waits for a free slot and for the turn of the request
+func (t *throttle) acquire(req *http.Request) error {
+	defer upstreamWait.ObserveSince(time.Now(), t.network)
+
+	ctx := req.Context()
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		wait := t.delay()
+		if wait <= 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			t.release()
+			return ctx.Err()
+		}
+	}
+}
+
+// delay returns how long to wait before sending, or takes a token
+// of the rate and returns zero
+func (t *throttle) delay() time.Duration {
+	t.Lock()
+	paused := t.paused.Sub(time.Now())
+	t.Unlock()
+	if paused > 0 {
+		return paused
+	}
+
+	if t.limiter == nil {
+		return 0
+	}
+	_, wait := t.limiter.take(t.network)
+	return wait
+}
+
+func (t *throttle) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// pause holds back the requests for the given time
+func (t *throttle) pause(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	if until := time.Now().Add(d); until.After(t.paused) {
+		t.paused = until
+	}
+}
+
+// retryAfter reads the delay of the Retry-After header, given either
+// in seconds or as an HTTP date
+func retryAfter(h http.Header) time.Duration {
+	d := defaultUpstreamRetryAfter
+
+	v := h.Get("Retry-After")
+	if seconds, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(v); err == nil {
+		d = date.Sub(time.Now())
+	}
+
+	if d < 0 {
+		return 0
+	}
+	if d > maxUpstreamRetryAfter {
+		return maxUpstreamRetryAfter
+	}
+	return d
+}
+
+// throttledTransport sends the requests through the throttle and
+// retries those turned down with 429 once the upstream allows it
+type throttledTransport struct {
+	throttle *throttle
+	next     http.RoundTripper
+}
+
+func newThrottledClient(t *throttle) *http.Client {
+	return &http.Client{Transport: &throttledTransport{t, http.DefaultTransport}}
+}
+
+// RoundTrip waits for the upstream outside of the network gate when
+// the context of the request carries the hold of the caller, and reads
+// the response before the caller takes the gate back. The requests of
+// the SDK carry no context and wait in the gate.
+func (tr *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer gate.suspend(gateHoldOf(req.Context()))()
+
+	resp, err := tr.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+func (tr *throttledTransport) send(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := tr.throttle.acquire(req); err != nil {
+			return nil, err
+		}
+		resp, err := tr.next.RoundTrip(req)
+		tr.throttle.release()
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		upstreamThrottled.Inc(tr.throttle.network)
+		tr.throttle.pause(retryAfter(resp.Header))
+
+		// a request whose body can't be sent again is left to fail
+		if attempt == maxUpstreamRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		retry := new(http.Request)
+		*retry = *req
+		if req.Body != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryAfter(t *testing.T) {
+	retry := func(value string) time.Duration {
+		h := http.Header{}
+		if value != "" {
+			h.Set("Retry-After", value)
+		}
+		return retryAfter(h)
+	}
+
+	assert.Equal(t, 3*time.Second, retry("3"))
+	assert.Equal(t, defaultUpstreamRetryAfter, retry(""))
+	assert.Equal(t, defaultUpstreamRetryAfter, retry("soon"))
+	assert.Equal(t, maxUpstreamRetryAfter, retry("3600"))
+	assert.Equal(t, time.Duration(0), retry("-1"))
+
+	date := retry(time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat))
+	assert.True(t, date > 8*time.Second && date <= 10*time.Second, date.String())
+	assert.Equal(t, time.Duration(0), retry(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+}
+
+func TestThrottledTransportRetriesTooManyRequests(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := newThrottledClient(newThrottle("test", 0, 0, 0))
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("transfer"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	// the retry sends the body again
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "transfer", string(body))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestThrottledTransportGivesUp(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := newThrottledClient(newThrottle("test", 0, 0, 0))
+	resp, err := client.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	}
+	assert.Equal(t, int32(maxUpstreamRetries+1), atomic.LoadInt32(&requests))
+}
+
+func TestThrottleQueuesBeyondTheConcurrencyCap(t *testing.T) {
+	var running, maxRunning int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := newThrottledClient(newThrottle("test", 0, 0, 2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestThrottlePausesAfterTooManyRequests(t *testing.T) {
+	th := newThrottle("test", 0, 0, 1)
+	th.pause(time.Hour)
+
+	// the queued request gives up with its context, leaving the slot free
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, th.acquire(req))
+	assert.Len(t, th.slots, 0)
+
+	th.Lock()
+	th.paused = time.Time{}
+	th.Unlock()
+	assert.NoError(t, th.acquire(httptest.NewRequest("GET", "/", nil)))
+	assert.Len(t, th.slots, 1)
+	th.release()
+}
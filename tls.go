@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+)
+
+// clientIdentities maps the common names of the client certificates
+// to the identities recorded for them. Certificates not listed are
+// identified by their common name.
+var clientIdentities map[string]string
+
+// verifyClientCertificates is set when the client certificates are
+// verified against tls_client_ca
+var verifyClientCertificates bool
+
+// certReloader serves the certificate and the client CA bundle
+// loaded last, so that they are replaced without a restart
+type certReloader struct {
+	sync.RWMutex
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(cfg *config) (*certReloader, error) {
+	r := &certReloader{
+		certFile: cfg.TLSCert,
+		keyFile:  cfg.TLSKey,
+		caFile:   cfg.TLSClientCA,
+	}
+
+	if r.caFile != "" {
+		switch cfg.TLSClientAuth {
+		case "", clientAuthRequire:
+			r.clientAuth = tls.RequireAndVerifyClientCert
+		case clientAuthOptional:
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown tls_client_auth: %q", cfg.TLSClientAuth)
+		}
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the files again. The ones served are kept if any fails.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the client CA bundle: %s", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in the client CA bundle %s", r.caFile)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	return nil
+}
+
+// tlsConfig returns the configuration of the server, which looks up
+// the current certificate and client CA bundle for each connection
+func (r *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.RLock()
+			defer r.RUnlock()
+			return r.cert, nil
+		},
+	}
+
+	if r.clientAuth != tls.NoClientCert {
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.RLock()
+			defer r.RUnlock()
+
+			c := base.Clone()
+			c.ClientAuth = r.clientAuth
+			c.ClientCAs = r.clientCAs
+			return c, nil
+		}
+	}
+
+	return base
+}
+
+// requireClientCertificate turns down the requests of the clients
+// which didn't present a verified certificate, when the certificates
+// are verified at all
+func requireClientCertificate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyClientCertificates {
+			return
+		}
+		if _, ok := certificateIdentity(c); !ok {
+			abortWithError(c, unauthenticatedError("a client certificate is required"))
+		}
+	}
+}
+
+// certificateIdentity returns the identity of the verified client
+// certificate, if any
+func certificateIdentity(c *gin.Context) (string, bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	if identity, ok := clientIdentities[name]; ok {
+		return identity, true
+	}
+	return name, true
+}
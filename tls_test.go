@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self-signed certificate of the common
+// name and its key as name.crt and name.key in the directory
+func writeTestCertificate(t *testing.T, dir, name, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, r *certReloader) string {
+	cert, err := r.tlsConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitmark-trade-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "server", "first")
+	r, err := newCertReloader(&config{TLSCert: certFile, TLSKey: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "first", servedCommonName(t, r))
+	assert.Nil(t, r.tlsConfig().GetConfigForClient)
+
+	writeTestCertificate(t, dir, "server", "renewed")
+	assert.NoError(t, r.reload())
+	assert.Equal(t, "renewed", servedCommonName(t, r))
+
+	// a broken renewal keeps the certificate served
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("not a key"), 0600))
+	assert.Error(t, r.reload())
+	assert.Equal(t, "renewed", servedCommonName(t, r))
+}
+
+func TestCertReloaderClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitmark-trade-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "server", "server")
+	caFile, _ := writeTestCertificate(t, dir, "ca", "ca")
+	cfg := &config{TLSCert: certFile, TLSKey: keyFile, TLSClientCA: caFile}
+
+	r, err := newCertReloader(cfg)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tls.RequireAndVerifyClientCert, r.clientAuth)
+	}
+
+	cfg.TLSClientAuth = clientAuthOptional
+	r, err = newCertReloader(cfg)
+	if assert.NoError(t, err) {
+		c, err := r.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		assert.NoError(t, err)
+		assert.Equal(t, tls.VerifyClientCertIfGiven, c.ClientAuth)
+		assert.NotNil(t, c.ClientCAs)
+	}
+
+	cfg.TLSClientAuth = "sometimes"
+	_, err = newCertReloader(cfg)
+	assert.EqualError(t, err, `unknown tls_client_auth: "sometimes"`)
+
+	// a bundle without certificates isn't taken, keeping the one served
+	cfg.TLSClientAuth = ""
+	r, err = newCertReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, ioutil.WriteFile(caFile, []byte("no certificate"), 0600))
+	assert.Error(t, r.reload())
+	assert.NotNil(t, r.clientCAs)
+}
+
+func TestMutualTLS(t *testing.T) {
+	defer func(identities map[string]string) { clientIdentities = identities }(clientIdentities)
+	clientIdentities = map[string]string{"backoffice": "ops"}
+
+	dir, err := ioutil.TempDir("", "bitmark-trade-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "server", "server")
+	clientCertFile, clientKeyFile := writeTestCertificate(t, dir, "client", "backoffice")
+	r, err := newCertReloader(&config{TLSCert: certFile, TLSKey: keyFile, TLSClientCA: clientCertFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) { c.String(http.StatusOK, callerIdentity(c)) })
+	server := httptest.NewUnstartedServer(router)
+	server.TLS = r.tlsConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	serverCert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newClient(clientCert).Get(server.URL)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ops", string(body))
+	}
+
+	// the handshake fails without a certificate of the bundle
+	otherCertFile, otherKeyFile := writeTestCertificate(t, dir, "other", "backoffice")
+	otherCert, err := tls.LoadX509KeyPair(otherCertFile, otherKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*http.Client{newClient(), newClient(otherCert)} {
+		if resp, err := client.Get(server.URL); err == nil {
+			resp.Body.Close()
+			t.Error("the request went through without a trusted certificate")
+		}
+	}
+}
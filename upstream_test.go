@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/tx"
+)
+
+// upstreamStub serves the Bitmark API, the key server and the asset
+// store to the testnet. The requests are answered on behalf of the
+// requester header, the signatures aren't checked.
+type upstreamStub struct {
+	sync.Mutex
+	server *httptest.Server
+
+	pubkeys  map[string]string
+	assets   map[string]*asset.Asset
+	contents map[string]*stubContent
+	bitmarks map[string]*bitmark.Bitmark
+	txs      map[string]*tx.Tx
+	sessions map[string]*stubSession
+	offset   int
+
+	// the session data posted for these recipients is turned down
+	failSessions map[string]bool
+
+	uploads        int
+	listPages      int
+	accessRequests int
+}
+
+type stubContent struct {
+	fileName string
+	data     []byte
+}
+
+type stubSession struct {
+	data   json.RawMessage
+	sender string
+}
+
+// stubTransport sends every request to the stub
+type stubTransport struct {
+	target *url.URL
+}
+
+func (tr stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	u.Scheme, u.Host = tr.target.Scheme, tr.target.Host
+	r.URL = &u
+	r.Host = u.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// useUpstreamStub points the testnet at a new stub, together with a
+// bolt storage and an asset cache of its own
+func useUpstreamStub(t *testing.T) (*upstreamStub, func()) {
+	s := &upstreamStub{
+		pubkeys:      make(map[string]string),
+		assets:       make(map[string]*asset.Asset),
+		contents:     make(map[string]*stubContent),
+		bitmarks:     make(map[string]*bitmark.Bitmark),
+		txs:          make(map[string]*tx.Tx),
+		sessions:     make(map[string]*stubSession),
+		failSessions: make(map[string]bool),
+	}
+	s.server = httptest.NewServer(s)
+	target, _ := url.Parse(s.server.URL)
+
+	closeStorage := openTestBoltStorage(t)
+
+	dir, err := ioutil.TempDir("", "bitmark-trade-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevCache, prevKeys := assetCache, dataKeys
+	dataKeys = newDataKeyCache(maxCachedDataKeys)
+	if assetCache, err = newContentCache(dir, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	n := defaultNetwork
+	prevSDK, prevService := n.sdk, n.service
+	client := &http.Client{Transport: &throttledTransport{newThrottle(string(n.name), 0, 0, 0), stubTransport{target}}}
+	n.sdk.HTTPClient = client
+	n.service = &Service{client, s.server.URL + "/api", s.server.URL + "/keys"}
+	n.activate()
+
+	return s, func() {
+		n.sdk, n.service = prevSDK, prevService
+		n.activate()
+		assetCache, dataKeys = prevCache, prevKeys
+		os.RemoveAll(dir)
+		closeStorage()
+		s.server.Close()
+	}
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newAccount creates a custodial account whose encryption key is
+// published on the key server
+func (s *upstreamStub) newAccount(t *testing.T) account.Account {
+	acct, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addAccount(acct); err != nil {
+		t.Fatal(err)
+	}
+	s.publishKey(acct)
+	return acct
+}
+
+// publishKey publishes the encryption key of an account held elsewhere
+func (s *upstreamStub) publishKey(acct account.Account) {
+	s.Lock()
+	defer s.Unlock()
+	s.pubkeys[acct.AccountNumber()] = hex.EncodeToString(getEncrKey(acct).PublicKeyBytes())
+}
+
+// addAsset registers the asset of the content and uploads the content
+// encrypted for the uploader
+func (s *upstreamStub) addAsset(t *testing.T, uploader account.Account, content []byte) *asset.Asset {
+	fingerprint := computeFingerprint(content)
+	a := &asset.Asset{
+		Id:          computeAssetId(fingerprint),
+		Name:        "asset",
+		Fingerprint: fingerprint,
+		Registrant:  uploader.AccountNumber(),
+		Status:      "confirmed",
+	}
+	s.Lock()
+	s.assets[a.Id] = a
+	s.Unlock()
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.uploadAsset(context.Background(), uploader, a.Id, "asset.txt", content, dataKey); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// addBitmark records a bitmark of the asset, without its session data
+func (s *upstreamStub) addBitmark(assetId, owner string) *bitmark.Bitmark {
+	s.Lock()
+	defer s.Unlock()
+	return s.issue(assetId, owner)
+}
+
+func (s *upstreamStub) issue(assetId, owner string) *bitmark.Bitmark {
+	s.offset++
+	b := &bitmark.Bitmark{
+		Id:      randomHex(32),
+		AssetId: assetId,
+		Issuer:  owner,
+		Owner:   owner,
+		Status:  "settled",
+		Commit:  s.offset,
+	}
+	b.LatestTxId = b.Id
+	s.bitmarks[b.Id] = b
+	s.txs[b.Id] = &tx.Tx{Id: b.Id, BitmarkId: b.Id, AssetId: assetId, Owner: owner, Status: "confirmed", Sequence: s.offset}
+	return b
+}
+
+func (s *upstreamStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case r.Method == "POST" && path == "/api/v1/assets":
+		s.uploadAsset(w, r)
+	case r.Method == "GET" && strings.HasPrefix(path, "/api/v1/bitmarks/") && strings.HasSuffix(path, "/asset"):
+		s.assetAccess(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/api/v1/bitmarks/"), "/asset"))
+	case r.Method == "POST" && path == "/api/v2/session":
+		s.addSession(w, r)
+	case r.Method == "POST" && strings.HasPrefix(path, "/api/v1/encryption_keys/"):
+		s.registerKey(w, r, strings.TrimPrefix(path, "/api/v1/encryption_keys/"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/keys/"):
+		s.encryptionKey(w, strings.TrimPrefix(path, "/keys/"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/content/"):
+		s.content(w, strings.TrimPrefix(path, "/content/"))
+
+	case r.Method == "GET" && path == "/v3/bitmarks":
+		s.listBitmarks(w, r)
+	case r.Method == "GET" && strings.HasPrefix(path, "/v3/bitmarks/"):
+		s.getBitmark(w, r, strings.TrimPrefix(path, "/v3/bitmarks/"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/v3/assets/"):
+		s.getAsset(w, strings.TrimPrefix(path, "/v3/assets/"))
+	case r.Method == "POST" && path == "/v3/register-asset":
+		s.registerAsset(w, r)
+	case r.Method == "POST" && path == "/v3/issue":
+		s.issueBitmarks(w, r)
+	case r.Method == "POST" && path == "/v3/transfer":
+		s.transfer(w, r)
+	case r.Method == "GET" && strings.HasPrefix(path, "/v3/txs/"):
+		s.getTx(w, r, strings.TrimPrefix(path, "/v3/txs/"))
+	default:
+		stubError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func stubJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func stubError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": status, "message": message})
+}
+
+func (s *upstreamStub) uploadAsset(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		stubError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, _ := ioutil.ReadAll(file)
+
+	assetId := r.FormValue("asset_id")
+	uploader := r.Header.Get("requester")
+	s.contents[assetId] = &stubContent{header.Filename, data}
+	s.sessions[assetId+"|"+uploader] = &stubSession{json.RawMessage(r.FormValue("session_data")), uploader}
+	s.uploads++
+	stubJSON(w, map[string]interface{}{})
+}
+
+// assetAccess returns the session data of the requester for the
+// bitmark, or the one of the uploader of the asset
+func (s *upstreamStub) assetAccess(w http.ResponseWriter, r *http.Request, bitmarkId string) {
+	s.accessRequests++
+	b, ok := s.bitmarks[bitmarkId]
+	if !ok {
+		stubError(w, http.StatusNotFound, "bitmark not found")
+		return
+	}
+
+	requester := r.Header.Get("requester")
+	session, ok := s.sessions[bitmarkId+"|"+requester]
+	if !ok {
+		session, ok = s.sessions[b.AssetId+"|"+requester]
+	}
+	if !ok {
+		stubError(w, http.StatusForbidden, "no session data")
+		return
+	}
+
+	stubJSON(w, map[string]interface{}{
+		"url":          s.server.URL + "/content/" + b.AssetId,
+		"session_data": session.data,
+		"sender":       session.sender,
+	})
+}
+
+func (s *upstreamStub) addSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		BitmarkId   string          `json:"bitmark_id"`
+		Owner       string          `json:"owner"`
+		SessionData json.RawMessage `json:"session_data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		stubError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if s.failSessions[req.Owner] {
+		stubError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+
+	s.sessions[req.BitmarkId+"|"+req.Owner] = &stubSession{req.SessionData, r.Header.Get("requester")}
+	stubJSON(w, map[string]interface{}{})
+}
+
+func (s *upstreamStub) registerKey(w http.ResponseWriter, r *http.Request, accountNo string) {
+	var req struct {
+		Key string `json:"encryption_pubkey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		stubError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.pubkeys[accountNo] = req.Key
+	stubJSON(w, map[string]interface{}{})
+}
+
+func (s *upstreamStub) encryptionKey(w http.ResponseWriter, accountNo string) {
+	key, ok := s.pubkeys[accountNo]
+	if !ok {
+		stubError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	stubJSON(w, map[string]string{"encryption_pubkey": key})
+}
+
+func (s *upstreamStub) content(w http.ResponseWriter, assetId string) {
+	c, ok := s.contents[assetId]
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.fileName))
+	w.Write(c.data)
+}
+
+// listBitmarks serves the bitmarks of an asset from the latest, a page
+// before the offset given by at
+func (s *upstreamStub) listBitmarks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	at, _ := strconv.Atoi(q.Get("at"))
+
+	var bitmarks []*bitmark.Bitmark
+	for _, b := range s.bitmarks {
+		if b.AssetId == q.Get("asset_id") && (at == 0 || b.Commit < at) {
+			bitmarks = append(bitmarks, b)
+		}
+	}
+	sort.Slice(bitmarks, func(i, j int) bool { return bitmarks[i].Commit > bitmarks[j].Commit })
+	if limit > 0 && len(bitmarks) > limit {
+		bitmarks = bitmarks[:limit]
+	}
+
+	s.listPages++
+	stubJSON(w, map[string]interface{}{"bitmarks": bitmarks, "assets": []*asset.Asset{}})
+}
+
+func (s *upstreamStub) getBitmark(w http.ResponseWriter, r *http.Request, bitmarkId string) {
+	b, ok := s.bitmarks[bitmarkId]
+	if !ok {
+		stubError(w, http.StatusNotFound, "bitmark not found")
+		return
+	}
+
+	result := map[string]interface{}{"bitmark": b}
+	if r.URL.Query().Get("asset") == "true" {
+		result["asset"] = s.assets[b.AssetId]
+	}
+	stubJSON(w, result)
+}
+
+func (s *upstreamStub) getAsset(w http.ResponseWriter, assetId string) {
+	a, ok := s.assets[assetId]
+	if !ok {
+		stubError(w, http.StatusNotFound, "asset not found")
+		return
+	}
+	stubJSON(w, map[string]interface{}{"asset": a})
+}
+
+func (s *upstreamStub) registerAsset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Assets []*asset.RegistrationParams `json:"assets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Assets) != 1 {
+		stubError(w, http.StatusBadRequest, "invalid registration")
+		return
+	}
+
+	p := req.Assets[0]
+	a := &asset.Asset{
+		Id:          computeAssetId(p.Fingerprint),
+		Name:        p.Name,
+		Fingerprint: p.Fingerprint,
+		Registrant:  p.Registrant,
+		Status:      "confirmed",
+	}
+	s.assets[a.Id] = a
+	stubJSON(w, map[string]interface{}{"assets": []map[string]string{{"id": a.Id}}})
+}
+
+func (s *upstreamStub) issueBitmarks(w http.ResponseWriter, r *http.Request) {
+	var req bitmark.IssuanceParams
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		stubError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var ids []map[string]string
+	for _, issue := range req.Issuances {
+		if _, ok := s.assets[issue.AssetId]; !ok {
+			stubError(w, http.StatusBadRequest, "asset not registered")
+			return
+		}
+		ids = append(ids, map[string]string{"id": s.issue(issue.AssetId, issue.Owner).Id})
+	}
+	stubJSON(w, map[string]interface{}{"bitmarks": ids})
+}
+
+func (s *upstreamStub) transfer(w http.ResponseWriter, r *http.Request) {
+	var req bitmark.TransferParams
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Transfer == nil {
+		stubError(w, http.StatusBadRequest, "invalid transfer")
+		return
+	}
+
+	link, ok := s.txs[req.Transfer.Link]
+	if !ok {
+		stubError(w, http.StatusBadRequest, "link not found")
+		return
+	}
+	b := s.bitmarks[link.BitmarkId]
+	if b.LatestTxId != link.Id {
+		stubError(w, http.StatusBadRequest, "link is not the latest transaction")
+		return
+	}
+
+	s.offset++
+	t := &tx.Tx{Id: randomHex(32), BitmarkId: b.Id, AssetId: b.AssetId, Owner: req.Transfer.Owner, Status: "pending", Sequence: s.offset, PreviousId: link.Id}
+	s.txs[t.Id] = t
+	b.Owner, b.LatestTxId, b.Status = t.Owner, t.Id, "transferring"
+	stubJSON(w, map[string]string{"txId": t.Id})
+}
+
+func (s *upstreamStub) getTx(w http.ResponseWriter, r *http.Request, txId string) {
+	t, ok := s.txs[txId]
+	if !ok {
+		stubError(w, http.StatusNotFound, "tx not found")
+		return
+	}
+	stubJSON(w, map[string]interface{}{"tx": t, "asset": s.assets[t.AssetId]})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	bmksdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/encoding"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// limits enforced by the Bitmark blockchain
+const (
+	maxAssetNameLength     = 64
+	maxAssetMetadataLength = 2048
+	maxIssueQuantity       = 100
+
+	accountNumberLength = 37 // key variant, public key and checksum
+	bitmarkIdLength     = 64
+	assetIdLength       = 128
+)
+
+// maxAssetFileSize limits the asset content uploaded for issuance
+const maxAssetFileSize = 100 << 20 // 100 MB
+
+// fieldErrors collects the validation failure of each request field
+type fieldErrors map[string]string
+
+func (f fieldErrors) add(field, message string) {
+	if _, ok := f[field]; !ok {
+		f[field] = message
+	}
+}
+
+func (f fieldErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+
+	e := validationError("invalid request parameters")
+	e.Fields = f
+	return e
+}
+
+// bindJSON decodes the request body and reports type mismatches per field
+func bindJSON(c *gin.Context, obj interface{}) error {
+	err := c.ShouldBindWith(obj, binding.JSON)
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" {
+		fields := fieldErrors{}
+		fields.add(e.Field, "must be of type "+e.Type.String())
+		return fields.err()
+	}
+	return validationError("invalid request body")
+}
+
+// bindIssueUpload reads an issue request sent as a multipart form
+// along with the content of the asset in its file part
+func bindIssueUpload(c *gin.Context, req *issueRequest) error {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAssetFileSize+1<<20)
+	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+		return validationError("invalid multipart form: %s", err)
+	}
+
+	fields := fieldErrors{}
+
+	req.Registrant = c.PostForm("registrant")
+	req.Name = c.PostForm("name")
+
+	if quantity := c.PostForm("quantity"); quantity != "" {
+		n, err := strconv.Atoi(quantity)
+		if err != nil {
+			fields.add("quantity", "must be of type int")
+		}
+		req.Quantity = n
+	}
+
+	if metadata := c.PostForm("metadata"); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &req.Metadata); err != nil {
+			fields.add("metadata", "must be a JSON object of strings")
+		}
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		fields.add("file", "is required")
+		return fields.err()
+	}
+	if fh.Size > maxAssetFileSize {
+		fields.add("file", fmt.Sprintf("exceeds %d bytes", maxAssetFileSize))
+		return fields.err()
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return validationError("unable to read the uploaded file")
+	}
+	defer f.Close()
+
+	if req.fileContent, err = ioutil.ReadAll(f); err != nil {
+		return validationError("unable to read the uploaded file")
+	}
+	if req.fileName = sanitizeFileName(fh.Filename); req.fileName == "" {
+		fields.add("file", "must have a file name")
+	}
+
+	return fields.err()
+}
+
+// validateAccountNumber checks the checksum of the account number
+// and that it belongs to the network the service runs on
+func validateAccountNumber(accountNo string) error {
+	if accountNo == "" {
+		return fmt.Errorf("is required")
+	}
+
+	// ParseAccountNumber doesn't guard against short input
+	if len(encoding.FromBase58(accountNo)) != accountNumberLength {
+		return fmt.Errorf("is not a valid account number")
+	}
+
+	network, _, err := account.ParseAccountNumber(accountNo)
+	if err != nil {
+		return fmt.Errorf("is not a valid account number")
+	}
+
+	if network != bmksdk.GetNetwork() {
+		return fmt.Errorf("belongs to %s instead of %s", network, bmksdk.GetNetwork())
+	}
+	return nil
+}
+
+func validateHexId(id string, length int) error {
+	if len(id) != length {
+		return fmt.Errorf("must be %d hex characters", length)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return fmt.Errorf("must be %d hex characters", length)
+	}
+	return nil
+}
+
+// compactMetadata joins the metadata the same way the asset record is packed
+func compactMetadata(metadata map[string]string) string {
+	parts := make([]string, 0, len(metadata)*2)
+	for key, val := range metadata {
+		if key == "" || val == "" {
+			continue
+		}
+		parts = append(parts, key, val)
+	}
+	return strings.Join(parts, "\u0000")
+}
+
+func (r *issueRequest) validate() error {
+	fields := fieldErrors{}
+
+	if err := validateAccountNumber(r.Registrant); err != nil {
+		fields.add("registrant", err.Error())
+	}
+
+	if r.AssetURL == "" && r.fileContent == nil {
+		fields.add("asset_url", "is required")
+	}
+
+	if n := utf8.RuneCountInString(r.Name); n == 0 || n > maxAssetNameLength {
+		fields.add("name", fmt.Sprintf("must be 1 to %d characters", maxAssetNameLength))
+	}
+
+	if utf8.RuneCountInString(compactMetadata(r.Metadata)) > maxAssetMetadataLength {
+		fields.add("metadata", fmt.Sprintf("exceeds %d characters when packed", maxAssetMetadataLength))
+	}
+
+	if r.Quantity < 1 || r.Quantity > maxIssueQuantity {
+		fields.add("quantity", fmt.Sprintf("must be between 1 and %d", maxIssueQuantity))
+	}
+
+	return fields.err()
+}
+
+func (r *transferRequest) validate() error {
+	fields := fieldErrors{}
+
+	if err := validateHexId(r.TxId, bitmarkIdLength); err != nil {
+		fields.add("txid", err.Error())
+	}
+
+	if err := validateAccountNumber(r.NextOnwer); err != nil {
+		fields.add("owner", err.Error())
+	}
+
+	return fields.err()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fieldsOf returns the invalid fields reported by the error
+func fieldsOf(err error) map[string]string {
+	if e, ok := err.(*TradeError); ok && e.Code == ErrCodeValidation {
+		return e.Fields
+	}
+	return nil
+}
+
+func newTestAccountNumber(t *testing.T) string {
+	acct, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acct.AccountNumber()
+}
+
+func TestValidateAccountNumber(t *testing.T) {
+	_, live := testNetworks(t)
+	live.activate()
+	liveAccountNo := newTestAccountNumber(t)
+	defaultNetwork.activate()
+
+	accountNo := newTestAccountNumber(t)
+	assert.NoError(t, validateAccountNumber(accountNo))
+
+	assert.EqualError(t, validateAccountNumber(""), "is required")
+	assert.EqualError(t, validateAccountNumber("account"), "is not a valid account number")
+	assert.EqualError(t, validateAccountNumber(accountNo[:len(accountNo)-4]), "is not a valid account number")
+	assert.EqualError(t, validateAccountNumber(liveAccountNo), "belongs to livenet instead of testnet")
+
+	// a character changed breaks the checksum
+	forged := []byte(accountNo)
+	if forged[10] == 'a' {
+		forged[10] = 'b'
+	} else {
+		forged[10] = 'a'
+	}
+	assert.Error(t, validateAccountNumber(string(forged)))
+}
+
+func TestValidateHexId(t *testing.T) {
+	assert.NoError(t, validateHexId(strings.Repeat("0f", 32), bitmarkIdLength))
+	assert.Error(t, validateHexId(strings.Repeat("0f", 31), bitmarkIdLength))
+	assert.Error(t, validateHexId(strings.Repeat("zz", 32), bitmarkIdLength))
+}
+
+func TestIssueRequestValidate(t *testing.T) {
+	valid := issueRequest{
+		AssetURL:   "file:///tmp/asset",
+		Registrant: newTestAccountNumber(t),
+		Name:       strings.Repeat("名", maxAssetNameLength),
+		Metadata:   map[string]string{"author": "someone"},
+		Quantity:   maxIssueQuantity,
+	}
+	assert.NoError(t, valid.validate())
+
+	// the content uploaded replaces the url
+	uploaded := valid
+	uploaded.AssetURL, uploaded.fileContent = "", []byte("content")
+	assert.NoError(t, uploaded.validate())
+
+	invalid := issueRequest{
+		Registrant: "registrant",
+		Name:       strings.Repeat("a", maxAssetNameLength+1),
+		Metadata:   map[string]string{"k": strings.Repeat("v", maxAssetMetadataLength)},
+	}
+	assert.Equal(t, map[string]string{
+		"registrant": "is not a valid account number",
+		"asset_url":  "is required",
+		"name":       "must be 1 to 64 characters",
+		"metadata":   "exceeds 2048 characters when packed",
+		"quantity":   "must be between 1 and 100",
+	}, fieldsOf(invalid.validate()))
+
+	// the empty metadata aren't packed
+	valid.Metadata = map[string]string{"": strings.Repeat("v", maxAssetMetadataLength+1)}
+	valid.Quantity = maxIssueQuantity + 1
+	assert.Equal(t, map[string]string{"quantity": "must be between 1 and 100"}, fieldsOf(valid.validate()))
+}
+
+func TestTransferRequestValidate(t *testing.T) {
+	req := transferRequest{TxId: strings.Repeat("a", bitmarkIdLength), NextOnwer: newTestAccountNumber(t)}
+	assert.NoError(t, req.validate())
+
+	req = transferRequest{TxId: "tx"}
+	assert.Equal(t, map[string]string{
+		"txid":  "must be 64 hex characters",
+		"owner": "is required",
+	}, fieldsOf(req.validate()))
+}
+
+func TestBindJSONReportsTheMistypedField(t *testing.T) {
+	bind := func(body string) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/issue", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", gin.MIMEJSON)
+		var req issueRequest
+		return bindJSON(c, &req)
+	}
+
+	assert.NoError(t, bind(`{"quantity": 1}`))
+	assert.Equal(t, map[string]string{"quantity": "must be of type int"}, fieldsOf(bind(`{"quantity": "1"}`)))
+
+	err := bind(`{"quantity":`)
+	assert.Equal(t, ErrCodeValidation, err.(*TradeError).Code)
+	assert.Nil(t, fieldsOf(err))
+}
+
+func TestBindIssueUpload(t *testing.T) {
+	bind := func(fields map[string]string, fileName, content string) (*issueRequest, error) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		if fileName != "" {
+			fw, _ := mw.CreateFormFile("file", fileName)
+			fw.Write([]byte(content))
+		}
+		mw.Close()
+
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/issue", &body)
+		c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+		var req issueRequest
+		return &req, bindIssueUpload(c, &req)
+	}
+
+	req, err := bind(map[string]string{
+		"registrant": "registrant",
+		"name":       "asset",
+		"quantity":   "2",
+		"metadata":   `{"author": "someone"}`,
+	}, "../asset.txt", "content")
+	assert.NoError(t, err)
+	assert.Equal(t, "asset.txt", req.fileName)
+	assert.Equal(t, []byte("content"), req.fileContent)
+	assert.Equal(t, 2, req.Quantity)
+	assert.Equal(t, map[string]string{"author": "someone"}, req.Metadata)
+
+	_, err = bind(map[string]string{"quantity": "two", "metadata": "[]"}, "", "")
+	assert.Equal(t, map[string]string{
+		"quantity": "must be of type int",
+		"metadata": "must be a JSON object of strings",
+		"file":     "is required",
+	}, fieldsOf(err))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiVersionKey = "api-version"
+
+	defaultPageSize = 100
+)
+
+// apiRoutesV2 registers the second version of the endpoints. It names
+// the collections in the plural, names the ids in snake case, reports
+// the errors as structured objects and wraps the lists in pagination
+// envelopes.
+func apiRoutesV2(r gin.IRoutes) {
+	r.POST("/accounts", limitRoute("account"), auditAction(AuditCreateAccount), createAccount())
+	r.POST("/bitmarks", limitRoute("issue"), trackInflight(), auditAction(AuditIssue), issueBitmarks())
+	r.POST("/transfers", limitRoute("transfer"), trackInflight(), auditAction(AuditTransfer), transferBitmark())
+	r.GET("/accounts/:accountNo/bitmarks/:bitmarkId/content", limitRoute("download"), auditAction(AuditDownload), downloadAsset())
+	r.POST("/downloads", limitRoute("download_token"), auditAction(AuditDownloadToken), requireClientCertificate(), issueDownloadToken())
+	r.POST("/assets/:assetId/rekey", limitRoute("rekey"), trackInflight(), auditAction(AuditRekey), rekeyAsset())
+	r.POST("/bitmarks/:bitmarkId/grants", limitRoute("grant"), trackInflight(), auditAction(AuditGrant), grantAccess())
+	r.GET("/bitmarks/:bitmarkId/grants", limitRoute("grants"), listAccessGrantsPage())
+	r.DELETE("/bitmarks/:bitmarkId/grants/:grantee", limitRoute("revoke"), trackInflight(), auditAction(AuditRevoke), revokeAccess())
+	r.GET("/audit/records", limitRoute("audit"), listAuditPage())
+	r.GET("/audit/verification", limitRoute("audit_verify"), verifyAudit())
+}
+
+// useAPIVersion marks the requests of the group with the API version
+func useAPIVersion(version int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(apiVersionKey, version)
+	}
+}
+
+func apiVersion(c *gin.Context) int {
+	if v, ok := c.Get(apiVersionKey); ok {
+		return v.(int)
+	}
+	return 1
+}
+
+// deprecated announces that the unversioned routes under the prefix
+// are superseded by the same routes under /v1
+func deprecated(prefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		successor := prefix + "/v1" + strings.TrimPrefix(c.Request.URL.Path, prefix)
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+successor+`>; rel="successor-version"`)
+	}
+}
+
+// fieldNamesV2 renames the fields of the requests whose name
+// changed in the second version
+var fieldNamesV2 = map[string]string{
+	"txid": "tx_id",
+}
+
+// transferRequestV2 names the transaction tx_id
+type transferRequestV2 struct {
+	TxId  string `json:"tx_id"`
+	Owner string `json:"owner"`
+}
+
+// bindTransferRequest binds the transfer request of the API version
+func bindTransferRequest(c *gin.Context, req *transferRequest) error {
+	if apiVersion(c) < 2 {
+		return bindJSON(c, req)
+	}
+
+	var v2 transferRequestV2
+	if err := bindJSON(c, &v2); err != nil {
+		return err
+	}
+	req.TxId, req.NextOnwer = v2.TxId, v2.Owner
+	return nil
+}
+
+// issueResultV2 returns the asset along with the bitmarks issued of it
+func issueResultV2(assetId string, bitmarkIds []string) gin.H {
+	bitmarks := make([]gin.H, 0, len(bitmarkIds))
+	for _, id := range bitmarkIds {
+		bitmarks = append(bitmarks, gin.H{"id": id})
+	}
+	return gin.H{"asset_id": assetId, "bitmarks": bitmarks}
+}
+
+// errorBodyV2 nests the error in an object, with the invalid
+// fields listed in order
+func errorBodyV2(e *TradeError) gin.H {
+	body := gin.H{
+		"code":    e.Code,
+		"message": e.Message,
+	}
+	if e.UpstreamCode != 0 {
+		body["upstream_code"] = e.UpstreamCode
+	}
+	if len(e.Fields) > 0 {
+		messages := make(map[string]string, len(e.Fields))
+		names := make([]string, 0, len(e.Fields))
+		for name, message := range e.Fields {
+			if renamed, ok := fieldNamesV2[name]; ok {
+				name = renamed
+			}
+			messages[name] = message
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fields := make([]gin.H, 0, len(names))
+		for _, name := range names {
+			fields = append(fields, gin.H{"name": name, "message": messages[name]})
+		}
+		body["fields"] = fields
+	}
+	return gin.H{"error": body}
+}
+
+// page is the envelope of a list. The next page is requested with
+// the cursor returned, which is omitted on the last page.
+type page struct {
+	Data       interface{} `json:"data"`
+	Pagination pagination  `json:"pagination"`
+}
+
+type pagination struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func pageLimit(c *gin.Context, max int) (int, error) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 || limit > max {
+		return 0, validationError("limit must be between 1 and %d", max)
+	}
+	return limit, nil
+}
+
+func listAccessGrantsPage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bitmarkId, ok := validateBitmarkIdParam(c)
+		if !ok {
+			return
+		}
+		limit, err := pageLimit(c, maxAuditPageSize)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		grants, err := listGrants(bitmarkId)
+		if err != nil {
+			abortWithError(c, internalError("failed to read the grants: %s", err))
+			return
+		}
+
+		// the grants are paged by grantee
+		sort.Slice(grants, func(i, j int) bool { return grants[i].Grantee < grants[j].Grantee })
+		cursor := c.Query("cursor")
+		start := sort.Search(len(grants), func(i int) bool { return grants[i].Grantee > cursor })
+		grants = grants[start:]
+
+		result := page{Data: grants, Pagination: pagination{Limit: limit}}
+		if len(grants) > limit {
+			result.Data = grants[:limit]
+			result.Pagination.NextCursor = grants[limit-1].Grantee
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+func listAuditPage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		after, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+		if err != nil {
+			abortWithError(c, validationError("cursor must be a sequence number"))
+			return
+		}
+		limit, err := pageLimit(c, maxAuditPageSize)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		// one more record tells whether there is a next page
+		records, err := listAuditRecords(after, limit+1, c.Query("account"), c.Query("action"))
+		if err != nil {
+			abortWithError(c, internalError("failed to read the audit log: %s", err))
+			return
+		}
+
+		result := page{Data: records, Pagination: pagination{Limit: limit}}
+		if len(records) > limit {
+			result.Data = records[:limit]
+			result.Pagination.NextCursor = strconv.FormatUint(records[limit-1].Sequence, 10)
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferFieldsNamedByVersion(t *testing.T) {
+	defer openTestBoltStorage(t)()
+	defer func(l *rateLimits) { limits = l }(limits)
+	initRateLimits(&config{})
+
+	r := newRouter()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/v1/transfer", `{"tx_id": "`+strings.Repeat("a", bitmarkIdLength)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var v1 struct {
+		Fields map[string]string `json:"fields"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v1))
+	assert.Contains(t, v1.Fields, "txid")
+
+	w = post("/v2/transfers", `{"tx_id": "`+strings.Repeat("a", bitmarkIdLength)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var v2 struct {
+		Error struct {
+			Fields []struct {
+				Name string `json:"name"`
+			} `json:"fields"`
+		} `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v2))
+	if assert.Len(t, v2.Error.Fields, 1) {
+		assert.Equal(t, "owner", v2.Error.Fields[0].Name)
+	}
+
+	w = post("/v2/transfers", `{"owner": "owner"}`)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v2))
+	if assert.Len(t, v2.Error.Fields, 2) {
+		assert.Equal(t, "owner", v2.Error.Fields[0].Name)
+		assert.Equal(t, "tx_id", v2.Error.Fields[1].Name)
+	}
+}